@@ -1,7 +1,7 @@
 package adb
 
 import (
-	"net"
+	"context"
 	"strconv"
 	"strings"
 
@@ -10,32 +10,147 @@ import (
 
 // ForwardSpec protocols
 const (
-	FProtocolTCP   = "tcp"
-	FProtocolLocal = "local"
-	FProtocolJDWP  = "jdwp"
-
-	// TODO(jmh): check if they are still in use.
+	FProtocolTCP        = "tcp"
+	FProtocolLocal      = "local"
+	FProtocolJDWP       = "jdwp"
 	FProtocolAbstract   = "localabstract"
 	FProtocolReserved   = "localreserved"
 	FProtocolFilesystem = "localfilesystem"
+	FProtocolVsock      = "vsock"
+	FProtocolAcceptFD   = "acceptfd"
 )
 
+// ForwardSpec is an endpoint of a forward, e.g. "tcp:8080" or
+// "localabstract:chrome_devtools_remote". Use ParseForwardSpec to validate
+// one or the typed constructors like TCPSpec to build one.
 type ForwardSpec string
 
-// Port returns -1 if the endpoint has no port.
+// TCPSpec returns the spec of a TCP port. Port 0 lets the server pick a
+// free port when forwarding, see ForwardToFreePort.
+func TCPSpec(port int) ForwardSpec {
+	return ForwardSpec(FProtocolTCP + ":" + strconv.Itoa(port))
+}
+
+// LocalSpec returns the spec of a unix domain socket. It is a path on the
+// host and a name in the android reserved namespace on the device.
+func LocalSpec(name string) ForwardSpec {
+	return ForwardSpec(FProtocolLocal + ":" + name)
+}
+
+// LocalAbstractSpec returns the spec of a unix domain socket in the abstract
+// namespace.
+func LocalAbstractSpec(name string) ForwardSpec {
+	return ForwardSpec(FProtocolAbstract + ":" + name)
+}
+
+// LocalReservedSpec returns the spec of a unix domain socket in the android
+// reserved namespace.
+func LocalReservedSpec(name string) ForwardSpec {
+	return ForwardSpec(FProtocolReserved + ":" + name)
+}
+
+// LocalFilesystemSpec returns the spec of a unix domain socket at path.
+func LocalFilesystemSpec(path string) ForwardSpec {
+	return ForwardSpec(FProtocolFilesystem + ":" + path)
+}
+
+// JDWPSpec returns the spec of the JDWP endpoint of the process pid. It is
+// only valid as the remote end of a forward.
+func JDWPSpec(pid int) ForwardSpec {
+	return ForwardSpec(FProtocolJDWP + ":" + strconv.Itoa(pid))
+}
+
+// VsockSpec returns the spec of a vsock port.
+func VsockSpec(cid, port uint32) ForwardSpec {
+	return ForwardSpec(FProtocolVsock + ":" + strconv.FormatUint(uint64(cid), 10) +
+		":" + strconv.FormatUint(uint64(port), 10))
+}
+
+// AcceptFDSpec returns the spec of an already listening socket passed to
+// the server as file descriptor fd. It is only valid as the local end of a
+// forward.
+func AcceptFDSpec(fd int) ForwardSpec {
+	return ForwardSpec(FProtocolAcceptFD + ":" + strconv.Itoa(fd))
+}
+
+// ParseForwardSpec validates s and returns it as ForwardSpec.
+func ParseForwardSpec(s string) (ForwardSpec, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 || i == len(s)-1 {
+		return "", errors.Errorf("malformed forward spec: %s", s)
+	}
+	proto, addr := s[:i], s[i+1:]
+	switch proto {
+	case FProtocolTCP:
+		if p, err := strconv.Atoi(addr); err != nil || p < 0 || p > 0xffff {
+			return "", errors.Errorf("malformed port: %s", addr)
+		}
+	case FProtocolJDWP, FProtocolAcceptFD:
+		if n, err := strconv.Atoi(addr); err != nil || n < 0 {
+			return "", errors.Errorf("malformed pid or fd: %s", addr)
+		}
+	case FProtocolVsock:
+		fields := strings.Split(addr, ":")
+		if len(fields) != 2 {
+			return "", errors.Errorf("malformed vsock address: %s", addr)
+		}
+		for _, f := range fields {
+			if _, err := strconv.ParseUint(f, 10, 32); err != nil {
+				return "", errors.Errorf("malformed vsock address: %s", addr)
+			}
+		}
+	case FProtocolLocal, FProtocolAbstract, FProtocolReserved, FProtocolFilesystem:
+		// Any name or path, it may contain colons.
+	default:
+		return "", errors.Errorf("unrecognized protocol: %s", proto)
+	}
+	return ForwardSpec(s), nil
+}
+
+// Port returns the port of tcp and vsock specs or -1 if the endpoint has no
+// port.
 func (f ForwardSpec) Port() int {
-	fields := strings.Split(string(f), ":")
-	if len(fields) < 2 {
+	switch f.Protocol() {
+	case FProtocolTCP:
+		return f.number(0)
+	case FProtocolVsock:
+		return f.number(1)
+	}
+	return -1
+}
+
+// CID returns the context id of a vsock spec or -1.
+func (f ForwardSpec) CID() int {
+	if f.Protocol() != FProtocolVsock {
 		return -1
 	}
-	if fields[0] != FProtocolTCP {
+	return f.number(0)
+}
+
+// PID returns the process id of a jdwp spec or -1.
+func (f ForwardSpec) PID() int {
+	if f.Protocol() != FProtocolJDWP {
 		return -1
 	}
-	p, err := strconv.Atoi(fields[1])
-	if err != nil {
+	return f.number(0)
+}
+
+// FD returns the file descriptor of an acceptfd spec or -1.
+func (f ForwardSpec) FD() int {
+	if f.Protocol() != FProtocolAcceptFD {
 		return -1
 	}
-	return p
+	return f.number(0)
+}
+
+// Name returns the socket name or path of local, localabstract,
+// localreserved and localfilesystem specs, and "" otherwise.
+func (f ForwardSpec) Name() string {
+	switch f.Protocol() {
+	case FProtocolLocal, FProtocolAbstract, FProtocolReserved, FProtocolFilesystem:
+		return f.addr()
+	}
+	return ""
 }
 
 func (f ForwardSpec) Protocol() string {
@@ -46,97 +161,213 @@ func (f ForwardSpec) Protocol() string {
 	return fields[0]
 }
 
-func isForwardSpec(s string) (ForwardSpec, error) {
-	fields := strings.Split(s, ":")
-	if len(fields) != 2 {
-		return "", errors.New("malformed forward spec")
-	}
-	switch fields[0] {
-	case FProtocolTCP, FProtocolJDWP:
-		if _, err := strconv.Atoi(fields[1]); err != nil {
-			return "", errors.Errorf("malformed pid or port: %s", fields[1])
-		}
-		return ForwardSpec(s), nil
-	case FProtocolLocal:
-		return ForwardSpec(s), nil
-	default:
-		return "", errors.Errorf("unrecognized protoclol: %s", fields[0])
+// addr returns everything after the protocol.
+func (f ForwardSpec) addr() string {
+	i := strings.IndexByte(string(f), ':')
+	if i < 0 {
+		return ""
 	}
+	return string(f[i+1:])
 }
 
-// ForwardList returns list with struct ForwardPair
-// If no device serial specified all devices's forward list will returned
-// [2]ForwardSpec is {local, remote} serial is d.serial
-func (d *Device) ForwardList() ([][2]ForwardSpec, error) {
-	attr, err := d.requestResponseString("list-forward")
+// number returns the i-th colon separated number of the address or -1.
+func (f ForwardSpec) number(i int) int {
+	fields := strings.Split(f.addr(), ":")
+	if i >= len(fields) {
+		return -1
+	}
+	n, err := strconv.Atoi(fields[i])
 	if err != nil {
-		return nil, err
+		return -1
 	}
+	return n
+}
+
+// ForwardEntry is a forward as listed by Server.ForwardListAll.
+type ForwardEntry struct {
+	Serial string
+	Local  ForwardSpec
+	Remote ForwardSpec
+}
+
+// ForwardListAll returns the forwards of all devices.
+func (s *Server) ForwardListAll() ([]ForwardEntry, error) {
+	return s.ForwardListAllContext(context.Background())
+}
 
-	fields := strings.Fields(string(attr))
-	if len(fields)%3 != 0 {
-		return nil, errors.Errorf("list forward parse error")
+// ForwardListAllContext is like ForwardListAll but aborts when ctx is done.
+func (s *Server) ForwardListAllContext(ctx context.Context) ([]ForwardEntry, error) {
+	b, err := s.requestResponseBytes(ctx, "list-forward")
+	if err != nil {
+		return nil, errors.WithMessage(err, "ForwardListAll")
 	}
-	fs := make([][2]ForwardSpec, 0, 2)
-	for i := 0; i < len(fields)/3; i++ {
-		var serial = fields[i*3]
-		// skip other device serial forwards
-		if d.serial == "host-serial:"+serial {
+	return parseForwardList(b)
+}
+
+// parseForwardList parses one "<serial> <local> <remote>" line per forward.
+func parseForwardList(b []byte) ([]ForwardEntry, error) {
+	var fs []ForwardEntry
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
 			continue
 		}
-		local, err := isForwardSpec(fields[i*3+1])
+		if len(fields) != 3 {
+			return nil, errors.Errorf("list forward parse error: %q", line)
+		}
+		local, err := ParseForwardSpec(fields[1])
 		if err != nil {
 			return nil, err
 		}
-		remote, err := isForwardSpec(fields[i*3+2])
+		remote, err := ParseForwardSpec(fields[2])
 		if err != nil {
 			return nil, err
 		}
-		fs = append(fs, [2]ForwardSpec{local, remote})
+		fs = append(fs, ForwardEntry{Serial: fields[0], Local: local, Remote: remote})
+	}
+	return fs, nil
+}
+
+// ForwardList returns the forwards of the device.
+// [2]ForwardSpec is {local, remote}
+func (d *Device) ForwardList() ([][2]ForwardSpec, error) {
+	return d.ForwardListContext(context.Background())
+}
+
+// ForwardListContext is like ForwardList but aborts when ctx is done.
+func (d *Device) ForwardListContext(ctx context.Context) ([][2]ForwardSpec, error) {
+	// The server lists the forwards of all devices whichever is addressed.
+	entries, err := d.server.ForwardListAllContext(ctx)
+	if err != nil {
+		return nil, errors.WithMessage(err, "ForwardList")
+	}
+	serial := d.serial
+	if serial == "" {
+		b, err := d.requestResponseString(ctx, "get-serialno")
+		if err != nil {
+			return nil, errors.WithMessage(err, "ForwardList")
+		}
+		serial = string(b)
+	}
+	fs := make([][2]ForwardSpec, 0, len(entries))
+	for _, e := range entries {
+		if e.Serial == serial {
+			fs = append(fs, [2]ForwardSpec{e.Local, e.Remote})
+		}
 	}
 	return fs, nil
 }
 
 // ForwardRemove specified forward
 func (d *Device) ForwardRemove(local ForwardSpec) error {
-	return d.send("killforward:" + string(local))
+	return d.ForwardRemoveContext(context.Background(), local)
+}
+
+// ForwardRemoveContext is like ForwardRemove but aborts when ctx is done.
+func (d *Device) ForwardRemoveContext(ctx context.Context, local ForwardSpec) error {
+	_, err := d.forward(ctx, "killforward:"+string(local), false)
+	return errors.WithMessage(err, "ForwardRemove")
 }
 
 // ForwardRemoveAll cancel all exists forwards
 func (d *Device) ForwardRemoveAll() error {
-	return d.send("killforward-all")
+	return d.ForwardRemoveAllContext(context.Background())
 }
 
-// Forward remote connection to local
-func (d *Device) Forward(local, remote ForwardSpec) error {
-	// last one colon too?!
-	err := d.send("forward:" + string(local) + ";" + string(remote))
-	return errors.WithMessage(err, "Forward")
+// ForwardRemoveAllContext is like ForwardRemoveAll but aborts when ctx is
+// done.
+func (d *Device) ForwardRemoveAllContext(ctx context.Context) error {
+	_, err := d.forward(ctx, "killforward-all", false)
+	return errors.WithMessage(err, "ForwardRemoveAll")
 }
 
-// ForwardToFreePort return random generated port
+// Forward remote connection to local. An existing forward on local is
+// replaced. It returns the bound local spec, which has the port picked by
+// the server if local is tcp:0.
+func (d *Device) Forward(local, remote ForwardSpec) (ForwardSpec, error) {
+	return d.ForwardContext(context.Background(), local, remote)
+}
+
+// ForwardContext is like Forward but aborts when ctx is done.
+func (d *Device) ForwardContext(ctx context.Context, local, remote ForwardSpec) (ForwardSpec, error) {
+	local, err := d.forwardTo(ctx, "forward:", local, remote)
+	return local, errors.WithMessage(err, "Forward")
+}
+
+// ForwardNoRebind is like Forward but fails if local is already forwarded.
+func (d *Device) ForwardNoRebind(local, remote ForwardSpec) (ForwardSpec, error) {
+	return d.ForwardNoRebindContext(context.Background(), local, remote)
+}
+
+// ForwardNoRebindContext is like ForwardNoRebind but aborts when ctx is
+// done.
+func (d *Device) ForwardNoRebindContext(ctx context.Context, local, remote ForwardSpec) (ForwardSpec, error) {
+	local, err := d.forwardTo(ctx, "forward:norebind:", local, remote)
+	return local, errors.WithMessage(err, "ForwardNoRebind")
+}
+
+// forwardTo forwards local to remote and returns local with the allocated
+// port if it was tcp:0.
+func (d *Device) forwardTo(ctx context.Context, cmd string, local, remote ForwardSpec) (ForwardSpec, error) {
+	pick := local == TCPSpec(0)
+	port, err := d.forward(ctx, cmd+string(local)+";"+string(remote), pick)
+	if err != nil {
+		return "", err
+	}
+	if pick {
+		return TCPSpec(port), nil
+	}
+	return local, nil
+}
+
+// ForwardToFreePort forwards a local tcp port picked by the server to
+// remote and returns it.
 // If forward already exists, just return current forworded port
 func (d *Device) ForwardToFreePort(remote ForwardSpec) (int, error) {
-	var getFreePort = func() int {
-		addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
-		if err != nil {
-			return 0
-		}
-		return addr.Port
-	}
+	return d.ForwardToFreePortContext(context.Background(), remote)
+}
 
-	fws, err := d.ForwardList()
+// ForwardToFreePortContext is like ForwardToFreePort but aborts when ctx is
+// done.
+func (d *Device) ForwardToFreePortContext(ctx context.Context, remote ForwardSpec) (int, error) {
+	fws, err := d.ForwardListContext(ctx)
 	if err != nil {
 		return 0, err
 	}
 	for _, fw := range fws {
 		if fw[1] == remote {
-			if fw[0].Port() == -1 {
+			if fw[0].Protocol() != FProtocolTCP {
 				return 0, errors.New("no local port")
 			}
 			return fw[0].Port(), nil
 		}
 	}
-	port := getFreePort()
-	return port, d.Forward(ForwardSpec(FProtocolTCP+strconv.Itoa(port)), remote)
+	port, err := d.forward(ctx, "forward:"+string(TCPSpec(0))+";"+string(remote), true)
+	return port, errors.WithMessage(err, "ForwardToFreePort")
+}
+
+// forward sends a forward request. The server answers with one status for
+// the request and one for its result, followed by the allocated port if
+// the local end was tcp:0 which is returned if wantPort is set.
+func (d *Device) forward(ctx context.Context, cmd string, wantPort bool) (int, error) {
+	conn, err := d.server.dialContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(d.server.shortDeadline(ctx))
+
+	err = sendMessage(conn, d.hostPrefix()+cmd)
+	for i := 0; i < 2 && err == nil; i++ {
+		err = wantStatus(conn)
+	}
+	if err != nil || !wantPort {
+		return 0, ctxErr(ctx, err)
+	}
+	b, err := readMessage(conn)
+	if err != nil {
+		return 0, ctxErr(ctx, err)
+	}
+	port, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	return port, errors.Wrapf(err, "malformed port %q", b)
 }
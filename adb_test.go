@@ -2,10 +2,18 @@ package adb
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestSendReadMessage(t *testing.T) {
@@ -34,6 +42,19 @@ func TestSendReadMessage(t *testing.T) {
 	}
 }
 
+func TestSendSyncMessage(t *testing.T) {
+	b := new(bytes.Buffer)
+	if err := sendSyncMessage(b, statusSyncStat, "/sdcard"); err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if want := "STAT\x07\x00\x00\x00/sdcard"; b.String() != want {
+		t.Errorf("want %q, got %q", want, b.String())
+	}
+	if err := sendMessage(b, strings.Repeat("a", 0x10000)); err == nil {
+		t.Error("want error for oversized message")
+	}
+}
+
 func TestWantStatus(t *testing.T) {
 	var compErrors = func(l, r error) bool {
 		if l == nil && r == nil {
@@ -81,3 +102,1534 @@ func TestServerVersion(t *testing.T) {
 		t.Errorf("%d - %d, err: %v", v, 2, err)
 	}
 }
+
+func TestServerVersionContextCanceled(t *testing.T) {
+	d := dial
+	dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		// Consume the request but never answer.
+		go io.Copy(ioutil.Discard, server)
+		return client, nil
+	}
+	defer func() { dial = d }()
+
+	s := &Server{
+		path:    "mock-path",
+		address: "mock-address",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err := s.VersionContext(ctx)
+	if err != context.Canceled {
+		t.Errorf("want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	var network, address string
+	mock := mockDial(t, "000chost:version", "OKAY00040029")
+	s, err := NewWithOptions(ServerOptions{
+		Network: "unix",
+		Address: "/tmp/adb.sock",
+		DialContext: func(ctx context.Context, n, a string) (net.Conn, error) {
+			network, address = n, a
+			return mock(ctx, n, a)
+		},
+		Timeout:     time.Second,
+		NoAutostart: true,
+	})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	v, err := s.Version()
+	if err != nil || v != 0x29 {
+		t.Errorf("%d - %d, err: %v", v, 0x29, err)
+	}
+	if network != "unix" || address != "/tmp/adb.sock" {
+		t.Errorf("dialed %s %s, want unix /tmp/adb.sock", network, address)
+	}
+}
+
+func TestServerOptionsFromEnv(t *testing.T) {
+	var tests = []struct {
+		env              map[string]string
+		network, address string
+		noAutostart      bool
+		err              bool
+	}{{
+		map[string]string{}, "tcp", "localhost:5037", false, false,
+	}, {
+		map[string]string{EnvServerPort: "5038"}, "tcp", "localhost:5038", false, false,
+	}, {
+		map[string]string{EnvServerAddress: "10.0.0.2"}, "tcp", "10.0.0.2:5037", true, false,
+	}, {
+		map[string]string{EnvServerPort: "-1"}, "", "", false, true,
+	}, {
+		map[string]string{EnvServerSocket: "tcp:5039", EnvServerPort: "5038"}, "tcp", "localhost:5039", false, false,
+	}, {
+		map[string]string{EnvServerSocket: "tcp:build-host:5037"}, "tcp", "build-host:5037", true, false,
+	}, {
+		map[string]string{EnvServerSocket: "tcp:[::1]:5037"}, "tcp", "[::1]:5037", false, false,
+	}, {
+		map[string]string{EnvServerSocket: "localfilesystem:/run/adb.sock"}, "unix", "/run/adb.sock", false, false,
+	}, {
+		map[string]string{EnvServerSocket: "localabstract:adb"}, "unix", "@adb", false, false,
+	}, {
+		map[string]string{EnvServerSocket: "vsock:2:5037"}, "", "", false, true,
+	}}
+	for _, test := range tests {
+		opts, err := serverOptionsFromEnv(func(k string) string { return test.env[k] })
+		if (err != nil) != test.err {
+			t.Errorf("%v: got unexpected error: %v", test.env, err)
+			continue
+		}
+		if opts.Network != test.network || opts.Address != test.address ||
+			opts.NoAutostart != test.noAutostart {
+
+			t.Errorf("%v: want %s %s %t, got %s %s %t", test.env,
+				test.network, test.address, test.noAutostart,
+				opts.Network, opts.Address, opts.NoAutostart)
+		}
+	}
+}
+
+func TestParseConnectResult(t *testing.T) {
+	var tests = []struct {
+		msg    string
+		result ConnectResult
+		err    bool
+	}{{
+		"connected to 10.0.0.2:5555", ConnectResult{"10.0.0.2:5555", false}, false,
+	}, {
+		"already connected to 10.0.0.2:5555", ConnectResult{"10.0.0.2:5555", true}, false,
+	}, {
+		"failed to connect to '10.0.0.2:5555': Connection refused", ConnectResult{}, true,
+	}, {
+		"failed to authenticate to 10.0.0.2:5555", ConnectResult{}, true,
+	}}
+	for _, test := range tests {
+		res, err := parseConnectResult("10.0.0.2:5555", test.msg)
+		if (err != nil) != test.err || res != test.result {
+			t.Errorf("%q: want %+v, got %+v, err: %v", test.msg, test.result, res, err)
+		}
+	}
+
+	pr, err := parsePairResult("10.0.0.2:37000",
+		"Successfully paired to 10.0.0.2:37000 [guid=adb-1234-abcd]")
+	if err != nil || pr != (PairResult{"10.0.0.2:37000", "adb-1234-abcd"}) {
+		t.Errorf("got %+v, err: %v", pr, err)
+	}
+	_, err = parsePairResult("10.0.0.2:37000", "Failed: Wrong password or connection was dropped.")
+	if _, ok := err.(*ConnectError); !ok {
+		t.Errorf("want *ConnectError, got %v", err)
+	}
+}
+
+func TestServerConnect(t *testing.T) {
+	d := dial
+	dial = mockDial(t, "001ahost:connect:10.0.0.2:5555", "OKAY001aconnected to 10.0.0.2:5555")
+	defer func() { dial = d }()
+
+	s := &Server{
+		path:    "mock-path",
+		address: "mock-address",
+	}
+	res, err := s.Connect("10.0.0.2", 0)
+	if err != nil || res.Address != "10.0.0.2:5555" {
+		t.Errorf("got %+v, err: %v", res, err)
+	}
+}
+
+func TestDeviceFeatures(t *testing.T) {
+	d := dial
+	dial = mockDial(t, "0018host-serial:abc:features", "OKAY0015shell_v2,cmd,stat_v2\n")
+	defer func() { dial = d }()
+
+	dev := &Device{
+		server: &Server{path: "mock-path", address: "mock-address"},
+		serial: "abc",
+	}
+	fs, err := dev.Features()
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if !fs.Has(FeatureShell2) || !fs.Has(FeatureStat2) || fs.Has(FeatureAbb) {
+		t.Errorf("got %v", fs)
+	}
+	// Cached, a second request would fail the mock.
+	dial = nil
+	if fs2, err := dev.Features(); err != nil || fs2.String() != "cmd,shell_v2,stat_v2" {
+		t.Errorf("got %v, err: %v", fs2, err)
+	}
+
+	// Host features are cached by the server, shared by all its devices.
+	dial = mockDial(t, "0012host:host-features", "OKAY0008shell_v2")
+	for i := 0; i < 2; i++ {
+		hfs, err := dev.server.HostFeatures()
+		if err != nil || hfs.String() != "shell_v2" {
+			t.Errorf("got %v, err: %v", hfs, err)
+		}
+		dial = nil
+	}
+}
+
+func TestParseDeviceLongTransportID(t *testing.T) {
+	di, err := parseDeviceLong("emulator-5554  device product:sdk_phone model:Pixel device:generic transport_id:7")
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if di.Serial != "emulator-5554" || di.Model != "Pixel" || di.TransportID != 7 {
+		t.Errorf("got %+v", di)
+	}
+}
+
+func TestDeviceRouting(t *testing.T) {
+	var tests = []struct {
+		dev       *Device
+		prefix    string
+		transport string
+	}{{
+		&Device{serial: "abc"}, "host-serial:abc:", "host:transport:abc",
+	}, {
+		&Device{serial: "abc", transportID: 3}, "host-transport-id:3:", "host:transport-id:3",
+	}, {
+		&Device{kind: kindUSB}, "host-usb:", "host:transport-usb",
+	}, {
+		&Device{kind: kindLocal}, "host-local:", "host:transport-local",
+	}}
+	for _, test := range tests {
+		if p := test.dev.hostPrefix(); p != test.prefix {
+			t.Errorf("want %s, got %s", test.prefix, p)
+		}
+		if r := test.dev.transportRequest(); r != test.transport {
+			t.Errorf("want %s, got %s", test.transport, r)
+		}
+	}
+}
+
+func TestDeviceListRoundTrip(t *testing.T) {
+	const list = "" +
+		"0123456789ABCDEF       device usb:1-1.2 product:sailfish model:Pixel device:sailfish transport_id:4\n" +
+		"emulator-5554          offline transport_id:5\n" +
+		"FA79J1A01234           no permissions (missing udev rules? user is in the plugdev group); see [http://developer.android.com/tools/device.html] usb:2-1 transport_id:6\n" +
+		"10.0.0.2:5555          unauthorized product:x model:y device:z transport_id:7 features:shell_v2,cmd\n"
+
+	devices, err := parseDeviceList(strings.NewReader(list), parseDeviceLong)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if len(devices) != 4 {
+		t.Fatalf("want 4 devices, got %d", len(devices))
+	}
+	if d := devices[0]; d.State != StateOnline || d.USB != "1-1.2" || d.TransportID != 4 {
+		t.Errorf("got %+v", d)
+	}
+	if d := devices[1]; d.State != StateOffline || d.TransportID != 5 {
+		t.Errorf("got %+v", d)
+	}
+	if d := devices[2]; !strings.HasPrefix(d.RawState, "no permissions (") || d.USB != "2-1" {
+		t.Errorf("got %+v", d)
+	}
+	if d := devices[3]; d.State != StateUnauthorized || d.Extra["features"] != "shell_v2,cmd" {
+		t.Errorf("got %+v", d)
+	}
+	if s := FormatDeviceInfo(devices); s != list {
+		t.Errorf("want\n%s\ngot\n%s", list, s)
+	}
+}
+
+func TestDeviceWaitFor(t *testing.T) {
+	d := dial
+	dial = mockDial(t, "0025host-serial:abc:wait-for-any-recovery", "OKAYOKAY")
+	defer func() { dial = d }()
+
+	dev := &Device{
+		server: &Server{path: "mock-path", address: "mock-address"},
+		serial: "abc",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := dev.WaitFor(ctx, StateRecovery); err != nil {
+		t.Errorf("got unexpected error: %v", err)
+	}
+	if err := dev.WaitFor(ctx, StateUnauthorized); err == nil {
+		t.Errorf("want error for unsupported state")
+	}
+}
+
+func TestDeviceReverse(t *testing.T) {
+	d := dial
+	defer func() { dial = d }()
+
+	dev := &Device{
+		server: &Server{path: "mock-path", address: "mock-address"},
+		serial: "abc",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	dial = mockDial(t, "0012host:transport:abc0021reverse:forward:tcp:8080;tcp:9090", "OKAYOKAYOKAY")
+	if err := dev.ReverseContext(ctx, "tcp:8080", "tcp:9090"); err != nil {
+		t.Errorf("got unexpected error: %v", err)
+	}
+
+	dial = mockDial(t, "0012host:transport:abc0021reverse:forward:tcp:8080;tcp:9090", "OKAYOKAYFAIL0005inuse")
+	if err := dev.ReverseContext(ctx, "tcp:8080", "tcp:9090"); err == nil {
+		t.Errorf("want error for failed reverse")
+	}
+
+	dial = mockDial(t, "0012host:transport:abc0014reverse:list-forward", "OKAYOKAY0017host tcp:8080 tcp:9090\n")
+	fs, err := dev.ReverseListContext(ctx)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if len(fs) != 1 || fs[0] != [2]ForwardSpec{"tcp:8080", "tcp:9090"} {
+		t.Errorf("got %v", fs)
+	}
+}
+
+func TestParseForwardSpec(t *testing.T) {
+	var tests = []struct {
+		in         string
+		valid      bool
+		proto      string
+		port, id   int
+		name       string
+		constructs ForwardSpec
+	}{
+		{"tcp:8080", true, FProtocolTCP, 8080, -1, "", TCPSpec(8080)},
+		{"tcp:x", false, "", 0, 0, "", ""},
+		{"jdwp:1234", true, FProtocolJDWP, -1, 1234, "", JDWPSpec(1234)},
+		{"localabstract:chrome_devtools_remote", true, FProtocolAbstract, -1, -1, "chrome_devtools_remote", LocalAbstractSpec("chrome_devtools_remote")},
+		{"localreserved:a:b", true, FProtocolReserved, -1, -1, "a:b", LocalReservedSpec("a:b")},
+		{"localfilesystem:/tmp/s", true, FProtocolFilesystem, -1, -1, "/tmp/s", LocalFilesystemSpec("/tmp/s")},
+		{"local:/tmp/s", true, FProtocolLocal, -1, -1, "/tmp/s", LocalSpec("/tmp/s")},
+		{"vsock:3:5000", true, FProtocolVsock, 5000, -1, "", VsockSpec(3, 5000)},
+		{"vsock:3", false, "", 0, 0, "", ""},
+		{"acceptfd:7", true, FProtocolAcceptFD, -1, 7, "", AcceptFDSpec(7)},
+		{"udp:53", false, "", 0, 0, "", ""},
+		{"tcp:", false, "", 0, 0, "", ""},
+	}
+	for _, test := range tests {
+		f, err := ParseForwardSpec(test.in)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got error %v", test.in, err)
+			continue
+		}
+		if !test.valid {
+			continue
+		}
+		id := f.PID()
+		if id == -1 {
+			id = f.FD()
+		}
+		if f.Protocol() != test.proto || f.Port() != test.port || id != test.id || f.Name() != test.name {
+			t.Errorf("%s: got %s %d %d %q", test.in, f.Protocol(), f.Port(), id, f.Name())
+		}
+		if f != test.constructs {
+			t.Errorf("%s: constructed %s", test.in, test.constructs)
+		}
+	}
+}
+
+func TestDeviceForward(t *testing.T) {
+	d := dial
+	defer func() { dial = d }()
+
+	dev := &Device{
+		server: &Server{path: "mock-path", address: "mock-address"},
+		serial: "abc",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	dial = mockDial(t, "0011host:list-forward",
+		"OKAY0049abc tcp:9222 localabstract:chrome_devtools_remote\nxyz tcp:1 vsock:3:5000\n")
+	all, err := dev.server.ForwardListAllContext(ctx)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if len(all) != 2 || all[1] != (ForwardEntry{"xyz", "tcp:1", "vsock:3:5000"}) {
+		t.Errorf("got %v", all)
+	}
+	fs, err := dev.ForwardListContext(ctx)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if len(fs) != 1 || fs[0] != [2]ForwardSpec{"tcp:9222", "localabstract:chrome_devtools_remote"} {
+		t.Errorf("got %v", fs)
+	}
+
+	dial = mockDial(t, "002fhost-serial:abc:forward:tcp:0;localabstract:foo", "OKAYOKAY000537512")
+	port, err := dev.forward(ctx, "forward:tcp:0;localabstract:foo", true)
+	if err != nil || port != 37512 {
+		t.Errorf("got %d, %v", port, err)
+	}
+
+	dial = mockDial(t, "0038host-serial:abc:forward:norebind:tcp:0;localabstract:foo", "OKAYOKAY000537512")
+	local, err := dev.ForwardNoRebindContext(ctx, TCPSpec(0), LocalAbstractSpec("foo"))
+	if err != nil || local != "tcp:37512" {
+		t.Errorf("got %q, %v", local, err)
+	}
+
+	dial = mockDial(t, "002fhost-serial:abc:forward:tcp:0;localabstract:foo", "OKAYFAIL0005inuse")
+	if _, err := dev.forward(ctx, "forward:tcp:0;localabstract:foo", true); err == nil {
+		t.Errorf("want error for failed forward")
+	}
+}
+
+func TestDeviceListen(t *testing.T) {
+	dev := &Device{
+		server: &Server{
+			path:    "mock-path",
+			address: "mock-address",
+			dial: tcpDial(t, func(conn net.Conn) {
+				defer conn.Close()
+				for _, want := range []string{"host:transport:abc", "tcp:80"} {
+					msg, err := readMessage(conn)
+					if err != nil || string(msg) != want {
+						t.Errorf("want %q, got %q, err: %v", want, msg, err)
+						return
+					}
+					io.WriteString(conn, statusOK)
+				}
+				// Echo the input once it was closed.
+				b, _ := ioutil.ReadAll(conn)
+				conn.Write(b)
+			}),
+		},
+		serial: "abc",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	f, err := dev.Listen(ctx, "tcp", "127.0.0.1:0", "tcp:80")
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", f.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(conn, "ping")
+		conn.(*net.TCPConn).CloseWrite()
+		b, err := ioutil.ReadAll(conn)
+		if err != nil || string(b) != "ping" {
+			t.Errorf("got %q, err: %v", b, err)
+		}
+		conn.Close()
+	}
+	if err := f.Close(); err != nil {
+		t.Errorf("got unexpected error: %v", err)
+	}
+	want := LocalForwardStats{Accepted: 2, BytesSent: 8, BytesReceived: 8}
+	if got := f.Stats(); got != want {
+		t.Errorf("want %+v, got %+v", want, got)
+	}
+	if _, err := dev.Listen(ctx, "tcp", "127.0.0.1:0", "udp:80"); err == nil {
+		t.Errorf("want error for invalid spec")
+	}
+}
+
+func TestDeviceDialContext(t *testing.T) {
+	services := make(chan string, 1)
+	dev := &Device{
+		server: &Server{
+			path:    "mock-path",
+			address: "mock-address",
+			dial: pipeDial(func(conn net.Conn) {
+				defer conn.Close()
+				for _, want := range []string{"host:transport:abc", ""} {
+					msg, err := readMessage(conn)
+					if err != nil || want != "" && string(msg) != want {
+						t.Errorf("want %q, got %q, err: %v", want, msg, err)
+						return
+					}
+					if want == "" {
+						services <- string(msg)
+					}
+					io.WriteString(conn, statusOK)
+				}
+				io.Copy(conn, conn)
+			}),
+		},
+		serial: "abc",
+	}
+
+	var tests = []struct {
+		network, address, service string
+	}{
+		{"tcp", "localhost:8080", "tcp:8080"},
+		{"tcp", ":http", "tcp:80"},
+		{"unix", "@chrome_devtools_remote", "localabstract:chrome_devtools_remote"},
+		{"unix", "/dev/socket/x", "localfilesystem:/dev/socket/x"},
+		{"localreserved", "x", "localreserved:x"},
+	}
+	for _, test := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		conn, err := dev.DialContext(ctx, test.network, test.address)
+		// The connection must outlive the context.
+		cancel()
+		if err != nil {
+			t.Errorf("%s %s: got unexpected error: %v", test.network, test.address, err)
+			continue
+		}
+		if got := <-services; got != test.service {
+			t.Errorf("want %q, got %q", test.service, got)
+		}
+		io.WriteString(conn, "ping")
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("got %q, err: %v", buf, err)
+		}
+		if conn.RemoteAddr().String() != test.address {
+			t.Errorf("got remote address %s", conn.RemoteAddr())
+		}
+		conn.Close()
+	}
+
+	if _, err := dev.DialContext(context.Background(), "tcp", "example.com:80"); err == nil {
+		t.Errorf("want error for remote host")
+	}
+}
+
+func TestOpenService(t *testing.T) {
+	d := dial
+	defer func() { dial = d }()
+
+	s := &Server{path: "mock-path", address: "mock-address"}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	dial = mockDial(t, "0012host:host-features", "OKAY000cshell_v2,cmd")
+	conn, err := s.OpenService(ctx, "host:host-features")
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	b, err := ReadMessage(conn)
+	if err != nil || string(b) != "shell_v2,cmd" {
+		t.Errorf("got %q, err: %v", b, err)
+	}
+	conn.Close()
+
+	dial = mockDial(t, "0012host:transport:abc000atrack-jdwp", "OKAYFAIL0007no jdwp")
+	dev := &Device{server: s, serial: "abc"}
+	if _, err := dev.OpenService(ctx, "track-jdwp"); err == nil || err.Error() != "no jdwp" {
+		t.Errorf("want FAIL message as error, got %v", err)
+	}
+}
+
+func TestDeviceTrackJDWP(t *testing.T) {
+	dev := &Device{
+		server: &Server{
+			path:    "mock-path",
+			address: "mock-address",
+			dial: pipeDial(func(conn net.Conn) {
+				defer conn.Close()
+				for _, want := range []string{"host:transport:abc", "track-jdwp"} {
+					msg, err := readMessage(conn)
+					if err != nil || string(msg) != want {
+						t.Errorf("want %q, got %q, err: %v", want, msg, err)
+						return
+					}
+					io.WriteString(conn, statusOK)
+				}
+				io.WriteString(conn, "0008100\n200\n")
+				io.WriteString(conn, "0008200\n300\n")
+			}),
+		},
+		serial: "abc",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pids, err := dev.JDWPPidsContext(ctx)
+	if err != nil || len(pids) != 2 || pids[0] != 100 || pids[1] != 200 {
+		t.Errorf("got %v, err: %v", pids, err)
+	}
+
+	tracker, err := dev.TrackJDWP(ctx)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	want := []JDWPEvent{{100, true}, {200, true}, {100, false}, {300, true}}
+	var got []JDWPEvent
+	for ev := range tracker.C() {
+		got = append(got, ev)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	}
+	if tracker.Err() == nil {
+		t.Errorf("want error once the connection is lost")
+	}
+}
+
+func TestDeviceTrackApp(t *testing.T) {
+	dev := &Device{
+		server: &Server{
+			path:    "mock-path",
+			address: "mock-address",
+			dial: pipeDial(func(conn net.Conn) {
+				defer conn.Close()
+				for _, want := range []string{"host:transport:abc", "track-app"} {
+					msg, err := readMessage(conn)
+					if err != nil || string(msg) != want {
+						t.Errorf("want %q, got %q, err: %v", want, msg, err)
+						return
+					}
+					io.WriteString(conn, statusOK)
+				}
+				// The first process has fields unknown to Android 12.
+				io.WriteString(conn, "0010\x0a\x0e\x08\xd2\x09\x18\x01\x3a\x05\x63\x6f\x6d\x2e\x78\x48\x01")
+				io.WriteString(conn, "001e\x0a\x0e\x08\xd2\x09\x18\x01\x3a\x05\x63\x6f\x6d\x2e\x78\x48\x01\x0a\x0c\x08\xd3\x09\x10\x01\x22\x05\x61\x72\x6d\x36\x34")
+				io.WriteString(conn, "0010\x0a\x0e\x08\xd3\x09\x10\x01\x22\x05\x61\x72\x6d\x36\x34\x18\x01")
+			}),
+		},
+		serial: "abc",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tracker, err := dev.TrackApp(ctx)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	var (
+		x   = AppProcess{Pid: 1234, Profileable: true}
+		y   = AppProcess{Pid: 1235, Debuggable: true, Architecture: "arm64"}
+		yp  = AppProcess{Pid: 1235, Debuggable: true, Profileable: true, Architecture: "arm64"}
+		got []AppEvent
+	)
+	want := []AppEvent{{AppAdded, x}, {AppAdded, y}, {AppRemoved, x}, {AppChanged, yp}}
+	for ev := range tracker.C() {
+		got = append(got, ev)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("want %v, got %v", want[i], got[i])
+		}
+	}
+	if tracker.Err() == nil {
+		t.Errorf("want error once the connection is lost")
+	}
+}
+
+func TestCmdRun(t *testing.T) {
+	for _, shell2 := range []bool{true, false} {
+		dev := &Device{
+			server: &Server{
+				path:    "mock-path",
+				address: "mock-address",
+				dial: pipeDial(func(conn net.Conn) {
+					defer conn.Close()
+					msg, err := readMessage(conn)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					switch string(msg) {
+					case "host-serial:abc:features", "host:host-features":
+						if shell2 {
+							io.WriteString(conn, "OKAY0008shell_v2")
+						} else {
+							io.WriteString(conn, "FAIL0004nope")
+						}
+						return
+					case "host:transport:abc":
+						io.WriteString(conn, statusOK)
+					default:
+						t.Errorf("unexpected request %q", msg)
+						return
+					}
+					msg, _ = readMessage(conn)
+					if !shell2 {
+						if string(msg) != "shell:echo a:b; echo :$?" {
+							t.Errorf("got %q", msg)
+						}
+						io.WriteString(conn, "OKAYa:b\r\n")
+						io.WriteString(conn, ":1\r\n")
+						return
+					}
+					if string(msg) != "shell,v2,raw:echo a:b" {
+						t.Errorf("got %q", msg)
+					}
+					io.WriteString(conn, statusOK)
+					// Echo stdin after the output.
+					var stdin []byte
+					for {
+						id, payload, err := readShellPacket(conn, nil)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if id == shellCloseStdin {
+							break
+						}
+						stdin = append(stdin, payload...)
+					}
+					writeShellPacket(conn, shellStdout, []byte("a:b\n"))
+					writeShellPacket(conn, shellStderr, []byte("oops"))
+					writeShellPacket(conn, shellStdout, stdin)
+					writeShellPacket(conn, shellExit, []byte{1})
+				}),
+			},
+			serial: "abc",
+		}
+		cmd := dev.Command("echo", "a:b")
+		if shell2 {
+			cmd.Stdin = strings.NewReader("xyz")
+		}
+		out, err := cmd.Output()
+		var exitErr *ShellExitError
+		if !errors.As(err, &exitErr) || exitErr.ExitCode != 1 || cmd.ExitCode() != 1 {
+			t.Errorf("shell2 %v: want exit code 1, got %v", shell2, err)
+			continue
+		}
+		if shell2 && (string(out) != "a:b\nxyz" || string(exitErr.Stderr) != "oops") {
+			t.Errorf("got output %q, stderr %q", out, exitErr.Stderr)
+		}
+		if !shell2 && string(out) != "a:b\r\n" {
+			t.Errorf("got output %q", out)
+		}
+		// The output of a command that ran is not kept.
+		if _, err := cmd.Output(); err == nil {
+			t.Errorf("want error for Output after Run")
+		}
+		if _, err := cmd.CombinedOutput(); err == nil {
+			t.Errorf("want error for CombinedOutput after Run")
+		}
+
+		cmd = dev.Command("echo", "a:b")
+		if shell2 {
+			stdin, _ := cmd.StdinPipe()
+			go func() {
+				io.WriteString(stdin, "xyz")
+				stdin.Close()
+			}()
+		}
+		stdout, _ := cmd.StdoutPipe()
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		out, err = ioutil.ReadAll(stdout)
+		if err != nil || !strings.HasPrefix(string(out), "a:b") {
+			t.Errorf("got %q, err: %v", out, err)
+		}
+		if err := cmd.Wait(); !errors.As(err, &exitErr) {
+			t.Errorf("want exit error, got %v", err)
+		}
+	}
+}
+
+func TestDeviceExec(t *testing.T) {
+	dev := &Device{
+		server: &Server{
+			path:    "mock-path",
+			address: "mock-address",
+			dial: tcpDial(t, func(conn net.Conn) {
+				defer conn.Close()
+				if msg, err := readMessage(conn); err != nil || string(msg) != "host:transport:abc" {
+					t.Errorf("got %q, err: %v", msg, err)
+					return
+				}
+				io.WriteString(conn, statusOK)
+				msg, err := readMessage(conn)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				io.WriteString(conn, statusOK)
+				switch string(msg) {
+				case "exec:screencap -p":
+					io.WriteString(conn, "\x89PNG\r\n\x1a\n")
+				case "exec:cat", "exec:cat > f && cat f":
+					// Echo the input once it was closed.
+					b, _ := ioutil.ReadAll(conn)
+					conn.Write(b)
+				default:
+					t.Errorf("unexpected service %q", msg)
+				}
+			}),
+		},
+		serial: "abc",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	r, err := dev.ExecOut(ctx, "screencap", "-p")
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(b) != "\x89PNG\r\n\x1a\n" {
+		t.Errorf("got %q, err: %v", b, err)
+	}
+
+	r, err = dev.Exec(ctx, strings.NewReader("data"), "cat")
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	b, err = ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(b) != "data" {
+		t.Errorf("got %q, err: %v", b, err)
+	}
+
+	r, err = dev.ExecScript(ctx, strings.NewReader("data"), "cat > f && cat f")
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	b, err = ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || string(b) != "data" {
+		t.Errorf("got %q, err: %v", b, err)
+	}
+
+	// The input cannot be ended on connections without CloseWrite.
+	dev.server.dial = pipeDial(func(conn net.Conn) {
+		defer conn.Close()
+		readMessage(conn)
+		io.WriteString(conn, statusOK)
+		readMessage(conn)
+		io.WriteString(conn, statusOK)
+		io.Copy(ioutil.Discard, conn)
+	})
+	if _, err := dev.Exec(ctx, strings.NewReader("data"), "cat"); err == nil {
+		t.Errorf("want error for connection without CloseWrite")
+	}
+}
+
+func TestDeviceCopyFile(t *testing.T) {
+	type upload struct {
+		header string
+		chunks []int
+		data   []byte
+		mtime  uint32
+	}
+	uploads := make(chan upload, 1)
+	dev := &Device{
+		server: &Server{
+			path:    "mock-path",
+			address: "mock-address",
+			dial: pipeDial(func(conn net.Conn) {
+				defer conn.Close()
+				if msg, err := readMessage(conn); err != nil || string(msg) != "host:transport:abc" {
+					t.Errorf("got %q, err: %v", msg, err)
+					return
+				}
+				io.WriteString(conn, statusOK)
+				if msg, err := readMessage(conn); err != nil || string(msg) != "sync:" {
+					t.Errorf("got %q, err: %v", msg, err)
+					return
+				}
+				io.WriteString(conn, statusOK)
+
+				var u upload
+				hdr := make([]byte, 8)
+				for {
+					if _, err := io.ReadFull(conn, hdr); err != nil {
+						t.Error(err)
+						return
+					}
+					id, n := string(hdr[:4]), binary.LittleEndian.Uint32(hdr[4:])
+					if id == "DONE" {
+						u.mtime = n
+						break
+					}
+					b := make([]byte, n)
+					if _, err := io.ReadFull(conn, b); err != nil {
+						t.Error(err)
+						return
+					}
+					switch id {
+					case "SEND":
+						u.header = string(b)
+					case "DATA":
+						u.chunks = append(u.chunks, int(n))
+						u.data = append(u.data, b...)
+					default:
+						t.Errorf("unexpected sync request %q", id)
+						return
+					}
+				}
+				uploads <- u
+				if strings.HasPrefix(u.header, "/readonly/") {
+					io.WriteString(conn, "FAIL\x0e\x00\x00\x00Read-only file")
+				} else {
+					io.WriteString(conn, "OKAY\x00\x00\x00\x00")
+				}
+			}),
+		},
+		serial: "abc",
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data := bytes.Repeat([]byte("0123456789"), 7000)
+	modtime := time.Unix(1500000000, 0)
+	n, err := dev.CopyFileContext(ctx, "/sdcard/f", bytes.NewReader(data), 0644, modtime)
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	if n != len(data) {
+		t.Errorf("got %d bytes written, want %d", n, len(data))
+	}
+	u := <-uploads
+	if u.header != "/sdcard/f,420" {
+		t.Errorf("got SEND %q, want %q", u.header, "/sdcard/f,420")
+	}
+	if len(u.chunks) != 2 || u.chunks[0] != syncMaxChunkSize {
+		t.Errorf("got chunks %v", u.chunks)
+	}
+	if !bytes.Equal(u.data, data) {
+		t.Errorf("got %d bytes of data, want %d", len(u.data), len(data))
+	}
+	if u.mtime != 1500000000 {
+		t.Errorf("got DONE %d, want %d", u.mtime, 1500000000)
+	}
+
+	_, err = dev.CopyFileContext(ctx, "/readonly/f", strings.NewReader("data"), 0644, modtime)
+	if err == nil || !strings.Contains(err.Error(), "Read-only file") {
+		t.Errorf("got %v, want the FAIL message", err)
+	}
+	<-uploads
+}
+
+func TestDeviceShell(t *testing.T) {
+	resized := make(chan string, 1)
+	dev := &Device{
+		server: &Server{
+			path:    "mock-path",
+			address: "mock-address",
+			dial: pipeDial(func(conn net.Conn) {
+				defer conn.Close()
+				msg, _ := readMessage(conn)
+				switch string(msg) {
+				case "host-serial:abc:features", "host:host-features":
+					io.WriteString(conn, "OKAY0008shell_v2")
+					return
+				case "host:transport:abc":
+					io.WriteString(conn, statusOK)
+				default:
+					t.Errorf("unexpected request %q", msg)
+					return
+				}
+				msg, _ = readMessage(conn)
+				if string(msg) != "shell,v2,TERM=xterm,pty:" {
+					t.Errorf("got %q", msg)
+				}
+				io.WriteString(conn, statusOK)
+				var sizes []string
+				for {
+					id, payload, err := readShellPacket(conn, nil)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					switch id {
+					case shellWindowSize:
+						sizes = append(sizes, string(payload))
+						if len(sizes) == 2 {
+							resized <- strings.Join(sizes, " ")
+						}
+					case shellStdin:
+						writeShellPacket(conn, shellStdout, payload)
+					case shellCloseStdin:
+						writeShellPacket(conn, shellExit, []byte{3})
+						return
+					}
+				}
+			}),
+		},
+		serial: "abc",
+	}
+	stdin, w := io.Pipe()
+	var out bytes.Buffer
+	s, err := dev.Shell(context.Background(), ShellOptions{
+		Term:   "xterm",
+		Stdin:  stdin,
+		Stdout: &out,
+		Rows:   24,
+		Cols:   80,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Resize(40, 120); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-resized; got != "24x80,0x0 40x120,0x0" {
+		t.Errorf("window sizes %q", got)
+	}
+	io.WriteString(w, "ls\n")
+	w.Close()
+	err = s.Wait()
+	var exitErr *ShellExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode != 3 || s.ExitCode() != 3 {
+		t.Errorf("want exit code 3, got %v", err)
+	}
+	if out.String() != "ls\n" {
+		t.Errorf("output %q", out.String())
+	}
+}
+
+func TestCmdCommandLine(t *testing.T) {
+	d := &Device{}
+	tests := []struct {
+		cmd   *Cmd
+		group bool
+		want  string
+	}{
+		{d.Command("ls", "-l", "/sdcard"), true, "ls -l /sdcard"},
+		{d.Command("ls", "a b", "it's", "", "$(reboot)"), false,
+			`ls 'a b' 'it'\''s' '' '$(reboot)'`},
+		{d.Command("/data/my tool", "*;`x`"), false, `'/data/my tool' '*;` + "`x`'"},
+		{d.Command("A=b", "--opt=1"), false, `'A=b' '--opt=1'`},
+		{&Cmd{Path: "pwd", Dir: "/data/it's", Env: []string{"A=1", "B=x y"}}, false,
+			`cd -- '/data/it'\''s' && export A=1 B='x y' && pwd`},
+		{d.Script("ls | grep x # list"), false, "ls | grep x # list"},
+		{d.Script("ls | grep x # list"), true, "{\nls | grep x # list\n}"},
+		{&Cmd{script: "ls &", Dir: "/"}, false, "cd -- / && {\nls &\n}"},
+		{&Cmd{script: "ls &", Dir: "/"}, true, "cd -- / && {\nls &\n}"},
+	}
+	for _, test := range tests {
+		got, err := test.cmd.commandLine(test.group)
+		if err != nil || got != test.want {
+			t.Errorf("want %q, got %q %v", test.want, got, err)
+		}
+	}
+	secret := &Cmd{Path: "curl", Args: []string{"-n"}, Env: []string{"TOKEN=secret"}}
+	if got := secret.name(); got != "curl -n" {
+		t.Errorf("got name %q, want it without the environment", got)
+	}
+	for _, env := range []string{"A", "=1", "1A=1", "A B=1", "A;reboot=1"} {
+		cmd := &Cmd{Path: "true", Env: []string{env}}
+		if _, err := cmd.commandLine(false); err == nil {
+			t.Errorf("env %q: want error", env)
+		}
+	}
+}
+
+func TestDeviceWatcherSlowC(t *testing.T) {
+	ready := make(chan struct{})
+	s := &Server{
+		path:    "mock-path",
+		address: "mock-address",
+		dial: pipeDial(func(conn net.Conn) {
+			defer conn.Close()
+			readMessage(conn)
+			io.WriteString(conn, statusOK)
+			<-ready
+			for i := 0; i < 20; i++ {
+				sendMessage(conn, "abc\tdevice\n")
+				sendMessage(conn, "abc\toffline\n")
+			}
+			io.Copy(ioutil.Discard, conn)
+		}),
+	}
+	w, err := s.NewDeviceWatcherContext(context.Background())
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	defer w.Close()
+	c := w.C()
+	other := w.Subscribe(SubscribeOptions{Buffer: 40})
+	defer other.Close()
+	close(ready)
+
+	// C is not read while the other subscriber receives every event.
+	timeout := time.After(time.Second)
+	for i := 0; i < 40; i++ {
+		select {
+		case <-other.C():
+		case <-timeout:
+			t.Fatalf("got %d events, a slow C stalls the other subscriber", i)
+		}
+	}
+	var last DeviceStateChangedEvent
+	for len(c) > 0 {
+		last = <-c
+	}
+	if last.NewState != StateOffline || w.legacy.Dropped() != 40-16 {
+		t.Errorf("got last event %+v with %d dropped", last, w.legacy.Dropped())
+	}
+}
+
+func TestDeviceWatcherBlockingSubscriber(t *testing.T) {
+	s := &Server{
+		path:    "mock-path",
+		address: "mock-address",
+		dial: pipeDial(func(conn net.Conn) {
+			defer conn.Close()
+			readMessage(conn)
+			io.WriteString(conn, statusOK)
+			sendMessage(conn, "abc\tdevice\n")
+			sendMessage(conn, "abc\toffline\n")
+			io.Copy(ioutil.Discard, conn)
+		}),
+	}
+	w, err := s.NewDeviceWatcherContext(context.Background())
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	defer w.Close()
+	blocked := w.Subscribe(SubscribeOptions{Buffer: 1, Drop: Block})
+
+	done := make(chan struct{})
+	go func() {
+		// The watcher blocks on the second event.
+		for w.Snapshot()["abc"] != StateOffline {
+			time.Sleep(time.Millisecond)
+		}
+		w.Subscribe(SubscribeOptions{}).Close()
+		blocked.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("blocking subscriber stalls the watcher")
+	}
+}
+
+func TestRecovererBackoff(t *testing.T) {
+	r := newRecoverer(RecoveryPolicy{
+		After:       10 * time.Second,
+		Backoff:     time.Second,
+		MaxBackoff:  3 * time.Second,
+		MaxAttempts: 4,
+	})
+	t0 := time.Unix(1000, 0)
+	r.observe(DeviceStateChangedEvent{Serial: "abc", OldState: StateOnline, NewState: StateOffline}, t0)
+
+	var attempts []time.Duration
+	for now := t0; now.Before(t0.Add(time.Minute)); now = now.Add(500 * time.Millisecond) {
+		for _, a := range r.due(now) {
+			if a.Serial != "abc" || a.State != StateOffline || a.Attempt != len(attempts)+1 {
+				t.Errorf("got %+v", a)
+			}
+			attempts = append(attempts, now.Sub(t0))
+		}
+	}
+	want := []time.Duration{10 * time.Second, 11 * time.Second, 13 * time.Second, 16 * time.Second}
+	if len(attempts) != len(want) {
+		t.Fatalf("want %v, got %v", want, attempts)
+	}
+	for i := range want {
+		if attempts[i] != want[i] {
+			t.Errorf("want %v, got %v", want, attempts)
+		}
+	}
+	if _, ok := r.next(); ok {
+		t.Errorf("want no further reconnects after MaxAttempts")
+	}
+
+	// Online for ResetAfter, which defaults to MaxBackoff, starts over.
+	t1 := t0.Add(time.Minute)
+	r.observe(DeviceStateChangedEvent{Serial: "abc", OldState: StateOffline, NewState: StateOnline}, t1)
+	r.due(t1.Add(3 * time.Second))
+	if len(r.stuck) != 0 {
+		t.Errorf("want device to be forgotten once online for a while")
+	}
+}
+
+func TestRecovererFlap(t *testing.T) {
+	r := newRecoverer(RecoveryPolicy{After: 10 * time.Second, ResetAfter: time.Minute})
+	t0 := time.Unix(1000, 0)
+	state := StateOnline
+	set := func(d time.Duration, s DeviceState) {
+		r.observe(DeviceStateChangedEvent{Serial: "abc", OldState: state, NewState: s}, t0.Add(d))
+		state = s
+	}
+	// The device flaps offline twice before it is due.
+	set(0, StateOffline)
+	set(4*time.Second, StateDisconnected)
+	set(5*time.Second, StateOffline)
+	set(7*time.Second, StateDisconnected)
+	set(8*time.Second, StateOffline)
+	if actions := r.due(t0.Add(17 * time.Second)); len(actions) != 0 {
+		t.Errorf("got %+v before the device was offline for 10s", actions)
+	}
+	actions := r.due(t0.Add(18 * time.Second))
+	if len(actions) != 1 || actions[0].State != StateOffline || !actions[0].Since.Equal(t0) {
+		t.Fatalf("want an action for offline since %v, got %+v", t0, actions)
+	}
+
+	// Once the device was online its next time offline starts anew.
+	set(20*time.Second, StateOnline)
+	set(25*time.Second, StateOffline)
+	actions = r.due(t0.Add(time.Minute))
+	if len(actions) != 1 || !actions[0].Since.Equal(t0.Add(25*time.Second)) || actions[0].Attempt != 2 {
+		t.Errorf("got %+v", actions)
+	}
+}
+
+func TestRecovererReappear(t *testing.T) {
+	r := newRecoverer(RecoveryPolicy{
+		After:       10 * time.Second,
+		Backoff:     20 * time.Second,
+		MaxBackoff:  time.Minute,
+		MaxAttempts: 3,
+		ResetAfter:  5 * time.Minute,
+	})
+	var attempts []time.Duration
+	t0 := time.Unix(1000, 0)
+	state := StateOnline
+	set := func(now time.Time, s DeviceState) {
+		r.observe(DeviceStateChangedEvent{Serial: "abc", OldState: state, NewState: s}, now)
+		state = s
+	}
+	set(t0, StateOffline)
+	for now := t0; now.Before(t0.Add(10 * time.Minute)); now = now.Add(time.Second) {
+		for _, a := range r.due(now) {
+			if a.Attempt != len(attempts)+1 {
+				t.Errorf("got %+v", a)
+			}
+			attempts = append(attempts, now.Sub(t0))
+			// The reconnect kicks the transport, which comes back offline.
+			set(now.Add(time.Second), StateDisconnected)
+			set(now.Add(2*time.Second), StateOffline)
+		}
+	}
+	want := []time.Duration{10 * time.Second, 30 * time.Second, 70 * time.Second}
+	if len(attempts) != len(want) {
+		t.Fatalf("want %v, got %v", want, attempts)
+	}
+	for i := range want {
+		if attempts[i] != want[i] {
+			t.Errorf("want %v, got %v", want, attempts)
+		}
+	}
+}
+
+func TestParseDeviceState(t *testing.T) {
+	var tests = []struct {
+		in    string
+		state DeviceState
+	}{
+		{"device", StateOnline},
+		{"offline", StateOffline},
+		{"unauthorized", StateUnauthorized},
+		{"bootloader", StateBootloader},
+		{"recovery", StateRecovery},
+		{"rescue", StateRescue},
+		{"sideload", StateSideload},
+		{"authorizing", StateAuthorizing},
+		{"connecting", StateConnecting},
+		{"host", StateHost},
+		{"detached", StateDetached},
+		{"no permissions (missing udev rules? user is in the plugdev group)", StateNoPermissions},
+		{"", StateInvalid},
+		{"bogus", StateInvalid},
+	}
+	for _, test := range tests {
+		if s := parseDeviceState(test.in); s != test.state {
+			t.Errorf("%q: want %v, got %v", test.in, test.state, s)
+		}
+	}
+
+	ev := DeviceStateChangedEvent{Serial: "abc", OldState: StateOnline, NewState: StateRecovery}
+	if !ev.EnteredRecovery() || !ev.WentOffline() || ev.EnteredBootloader() || !ev.Left(StateOnline) {
+		t.Errorf("wrong classification of %+v", ev)
+	}
+}
+
+// pipeDial returns a dialer whose connections are served by serve.
+func pipeDial(serve func(conn net.Conn)) func(ctx context.Context, n, a string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go serve(server)
+		return client, nil
+	}
+}
+
+// tcpDial is like pipeDial but connects over loopback TCP, so the
+// connections can be closed for writing only.
+func tcpDial(t *testing.T, serve func(conn net.Conn)) func(ctx context.Context, n, a string) (net.Conn, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", l.Addr().String())
+	}
+}
+
+func TestDeviceWatcherLong(t *testing.T) {
+	lists := []string{
+		"abc device usb:1-1 product:p model:m device:d transport_id:1\n",
+		"abc device usb:1-2 product:p model:m device:d transport_id:2\n",
+		"",
+	}
+	ready := make(chan struct{})
+	s := &Server{
+		path:    "mock-path",
+		address: "mock-address",
+		dial: pipeDial(func(conn net.Conn) {
+			defer conn.Close()
+			msg, err := readMessage(conn)
+			if err != nil || string(msg) != "host:track-devices-l" {
+				t.Errorf("got %q, err: %v", msg, err)
+				return
+			}
+			io.WriteString(conn, statusOK)
+			<-ready
+			for _, list := range lists {
+				sendMessage(conn, list)
+			}
+			io.Copy(ioutil.Discard, conn)
+		}),
+	}
+	w, err := s.NewDeviceWatcherWithOptions(context.Background(), DeviceWatcherOptions{Long: true})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	defer w.Close()
+	c := w.C()
+	close(ready)
+
+	ev := <-c
+	if !ev.CameOnline() || ev.New.USB != "1-1" {
+		t.Errorf("got %+v", ev)
+	}
+	ev = <-c
+	if ev.StateChanged() || ev.Old.USB != "1-1" || ev.New.USB != "1-2" || ev.New.TransportID != 2 {
+		t.Errorf("got %+v", ev)
+	}
+	ev = <-c
+	if !ev.Disconnected() || ev.Old.USB != "1-2" {
+		t.Errorf("got %+v", ev)
+	}
+}
+
+func TestDiffDevicesSharedSerial(t *testing.T) {
+	usb := DeviceInfo{Serial: "abc", State: StateOnline, USB: "1-1", TransportID: 1}
+	tcp := DeviceInfo{Serial: "abc", State: StateOnline, TransportID: 2}
+	known := make(map[deviceKey]DeviceInfo)
+
+	events := diffDevices(known, []DeviceInfo{usb, tcp}, true)
+	if len(events) != 2 || events[0].New.TransportID != 1 || events[1].New.TransportID != 2 {
+		t.Errorf("got %+v", events)
+	}
+	if events = diffDevices(known, []DeviceInfo{usb, tcp}, true); len(events) != 0 {
+		t.Errorf("want no events for an unchanged list, got %+v", events)
+	}
+	// The USB device moves to another port and gets a new transport.
+	moved := usb
+	moved.USB, moved.TransportID = "1-2", 3
+	events = diffDevices(known, []DeviceInfo{tcp, moved}, true)
+	if len(events) != 1 || events[0].StateChanged() || events[0].Old.TransportID != 1 || events[0].New.TransportID != 3 {
+		t.Errorf("got %+v", events)
+	}
+	events = diffDevices(known, []DeviceInfo{moved}, true)
+	if len(events) != 1 || !events[0].Disconnected() || events[0].Old.TransportID != 2 {
+		t.Errorf("got %+v", events)
+	}
+	if len(known) != 1 {
+		t.Errorf("got %v", known)
+	}
+}
+
+func TestDeviceWatcherReconnect(t *testing.T) {
+	var dials int32
+	ready := make(chan struct{})
+	s := &Server{
+		path:        "mock-path",
+		address:     "mock-address",
+		noAutostart: true,
+		dial: pipeDial(func(conn net.Conn) {
+			defer conn.Close()
+			n := atomic.AddInt32(&dials, 1)
+			if _, err := readMessage(conn); err != nil {
+				return
+			}
+			if n == 2 {
+				// Server still down.
+				io.WriteString(conn, "FAIL0004dead")
+				return
+			}
+			io.WriteString(conn, statusOK)
+			<-ready
+			sendMessage(conn, "abc\tdevice\n")
+			if n > 1 {
+				io.Copy(ioutil.Discard, conn)
+			}
+			// First connection dies, as if the server was killed.
+		}),
+	}
+	w, err := s.NewDeviceWatcherWithOptions(context.Background(), DeviceWatcherOptions{
+		MinBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	c := w.C()
+	close(ready)
+
+	for _, want := range []DeviceState{StateOnline, StateDisconnected, StateOnline} {
+		select {
+		case ev := <-c:
+			if ev.Serial != "abc" || ev.NewState != want {
+				t.Errorf("want %v, got %+v", want, ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %v", want)
+		}
+	}
+
+	closed := make(chan error)
+	go func() { closed <- w.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("got unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Close blocked")
+	}
+	if _, ok := <-c; ok {
+		t.Errorf("want channel to be closed")
+	}
+}
+
+func TestDeviceWatcherCloseWhileStarting(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a shell script")
+	}
+	// An adb that hangs while starting the server.
+	path := filepath.Join(t.TempDir(), "adb")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var dials int32
+	s := &Server{
+		path:    path,
+		address: "mock-address",
+		dial: pipeDial(func(conn net.Conn) {
+			defer conn.Close()
+			if atomic.AddInt32(&dials, 1) > 1 {
+				return
+			}
+			readMessage(conn)
+			io.WriteString(conn, statusOK)
+			sendMessage(conn, "abc\tdevice\n")
+			// The connection dies, as if the server was killed.
+		}),
+	}
+	w, err := s.NewDeviceWatcherWithOptions(context.Background(), DeviceWatcherOptions{
+		MinBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	c := w.C()
+	for _, want := range []DeviceState{StateOnline, StateDisconnected} {
+		if ev := <-c; ev.NewState != want {
+			t.Errorf("want %v, got %+v", want, ev)
+		}
+	}
+	// Give the watcher time to run adb start-server.
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan error)
+	go func() { closed <- w.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("got unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close blocked on adb start-server")
+	}
+}
+
+func TestDeviceWatcherSubscribe(t *testing.T) {
+	ready := make(chan struct{})
+	s := &Server{
+		path:    "mock-path",
+		address: "mock-address",
+		dial: pipeDial(func(conn net.Conn) {
+			defer conn.Close()
+			readMessage(conn)
+			io.WriteString(conn, statusOK)
+			<-ready
+			sendMessage(conn, "abc\toffline\ndef\toffline\n")
+			sendMessage(conn, "abc\tdevice\ndef\toffline\n")
+			sendMessage(conn, "abc\trecovery\ndef\tdevice\n")
+			io.Copy(ioutil.Discard, conn)
+		}),
+	}
+	w, err := s.NewDeviceWatcherContext(context.Background())
+	if err != nil {
+		t.Fatalf("got unexpected error: %v", err)
+	}
+	defer w.Close()
+
+	// Never read, must not stall the others.
+	stalled := w.Subscribe(SubscribeOptions{Buffer: 1, Drop: DropNewest})
+	idle := w.Subscribe(SubscribeOptions{Buffer: 1})
+	abc := w.Subscribe(SubscribeOptions{Serial: "abc"})
+	online := w.Subscribe(SubscribeOptions{
+		Filter: func(ev DeviceStateChangedEvent) bool { return ev.CameOnline() },
+	})
+	close(ready)
+
+	for _, want := range []DeviceState{StateOffline, StateOnline, StateRecovery} {
+		if ev := <-abc.C(); ev.Serial != "abc" || ev.NewState != want {
+			t.Errorf("want abc %v, got %+v", want, ev)
+		}
+	}
+	for _, want := range []string{"abc", "def"} {
+		if ev := <-online.C(); ev.Serial != want || ev.NewState != StateOnline {
+			t.Errorf("want %s online, got %+v", want, ev)
+		}
+	}
+	if stalled.Dropped() != 4 {
+		t.Errorf("want 4 dropped events, got %d", stalled.Dropped())
+	}
+	if idle.Dropped() != 4 {
+		t.Errorf("want 4 dropped events, got %d", idle.Dropped())
+	}
+	// The oldest events were dropped.
+	if ev := <-idle.C(); ev.Serial != "def" || ev.NewState != StateOnline {
+		t.Errorf("got %+v", ev)
+	}
+
+	snap := w.Snapshot()
+	if len(snap) != 2 || snap["abc"] != StateRecovery || snap["def"] != StateOnline {
+		t.Errorf("got %v", snap)
+	}
+	late := w.Subscribe(SubscribeOptions{})
+	if late.Snapshot()["def"] != StateOnline {
+		t.Errorf("got %v", late.Snapshot())
+	}
+	late.Close()
+	if _, ok := <-late.C(); ok {
+		t.Errorf("want channel to be closed")
+	}
+}
@@ -1,7 +1,10 @@
 package adb
 
 import (
-	"fmt"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
 	"net"
 	"strconv"
 	"strings"
@@ -10,31 +13,51 @@ import (
 	"github.com/pkg/errors"
 )
 
-// Cmd represents a command that can be executed on a device.
+// Cmd represents a command that can be executed on a device. Like
+// os/exec.Cmd its input and output are streamed while it runs.
 // Use Command to get an instance.
 type Cmd struct {
 	Path string
 	Args []string
 
+	// Env holds variables in the form "key=value" that are exported to the
+	// command in addition to the environment of the device shell.
+	Env []string
+	// Dir is the working directory of the command. It defaults to the one
+	// of the device shell.
+	Dir string
+
+	// Stdin is sent to the command if set, otherwise the command reads an
+	// empty input. It requires shell protocol v2, see FeatureShell2.
+	// Wait does not wait for Stdin to be consumed.
+	Stdin io.Reader
+	// Stdout and Stderr receive the output of the command. It is discarded
+	// if they are nil. Devices without shell protocol v2 mix the error
+	// output into Stdout.
+	Stdout io.Writer
+	Stderr io.Writer
+
+	script   string // run verbatim instead of Path and Args, see Script
 	exitCode int
 	conn     net.Conn
-	output   []byte
+	shell2   bool // conn speaks the shell protocol v2
 	device   *Device
 
-	// does this work?
-	env []string
+	// done is closed once the output is copied, setting copyExit and
+	// copyErr.
+	done     chan struct{}
+	copyExit int
+	copyErr  error
+
+	// Set up by the pipe methods.
+	closeAfterCopy []io.Closer
+	closeAfterWait []io.Closer
 }
 
-// Command sets up a command to execute on device d. Command takes ownership of
-// args.
+// Command sets up a command to execute on device d. The device runs it with
+// its shell, cmd and args are quoted so that the shell passes them on
+// unchanged.
 func (d *Device) Command(cmd string, args ...string) *Cmd {
-	for i, arg := range args {
-		if strings.ContainsAny(arg, " \t\n\v\r") &&
-			!(arg[0] == '"' && arg[len(arg)-1] == '"') {
-
-			args[i] = `"` + arg + `"`
-		}
-	}
 	return &Cmd{
 		Path:     cmd,
 		Args:     args,
@@ -43,22 +66,175 @@ func (d *Device) Command(cmd string, args ...string) *Cmd {
 	}
 }
 
+// Script sets up a shell script to execute on device d. Unlike Command the
+// script is passed to the device shell verbatim, so pipes, redirections and
+// expansions work. Never build it from untrusted input, use Command instead.
+func (d *Device) Script(script string) *Cmd {
+	return &Cmd{
+		script:   script,
+		device:   d,
+		exitCode: -1,
+	}
+}
+
+// StartTimeout sends command to device. The connection times out at timeout.
 func (c *Cmd) StartTimeout(timeout time.Time) error {
-	conn, err := dial(c.device.server.address)
+	return c.start(context.Background(), timeout)
+}
+
+// StartContext sends command to device. The command is aborted and its
+// connection closed when ctx is done.
+func (c *Cmd) StartContext(ctx context.Context) error {
+	deadline, _ := ctx.Deadline()
+	return c.start(ctx, deadline)
+}
+
+func (c *Cmd) start(ctx context.Context, deadline time.Time) error {
+	if c.done != nil {
+		return errors.New("command already started")
+	}
+	err := c.open(ctx, deadline)
+	if err != nil {
+		closeAll(c.closeAfterCopy)
+		closeAll(c.closeAfterWait)
+		return err
+	}
+
+	stdout, stderr := c.Stdout, c.Stderr
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+	conn := c.conn
+	c.done = make(chan struct{})
+	if c.shell2 {
+		go copyShellStdin(conn, c.Stdin)
+		go c.copyOutput(func() (int, error) {
+			return demuxShell(conn, stdout, stderr)
+		})
+	} else {
+		go c.copyOutput(func() (int, error) {
+			return copyLegacyShell(conn, stdout)
+		})
+	}
+	return nil
+}
+
+// open connects to the shell service running the command.
+func (c *Cmd) open(ctx context.Context, deadline time.Time) error {
+	// The shell protocol v2 keeps stdout and stderr apart and reports the
+	// exit code out of band. Without it the exit code is echoed after the
+	// output.
+	c.shell2 = c.device.hasFeature(ctx, FeatureShell2)
+	if c.Stdin != nil && !c.shell2 {
+		return errors.New("Stdin requires shell protocol v2")
+	}
+	line, err := c.commandLine(!c.shell2)
+	if err != nil {
+		return err
+	}
+	service := "shell:" + line + "; echo :$?"
+	if c.shell2 {
+		service = "shell,v2,raw:" + line
+	}
+	conn, err := c.device.OpenService(ctx, service)
 	if err != nil {
 		return err
 	}
-	conn.SetDeadline(timeout)
+	conn.SetDeadline(deadline)
 	c.conn = conn
-	buf := []byte("0000" + "host-serial:" + c.device.serial + ":shell:")
-	buf = append(buf, []byte(c.Path+" "+strings.Join(c.Args, " ")+"; echo :$?")...)
-	length := len(buf) - 4
-	if length > 65535 {
-		return errors.Errorf("message exceeds maximum length: %d", length)
+	return nil
+}
+
+// commandLine returns the line the device shell runs. Dir and Env are set
+// up by a prefix which stops the command if it fails. If group is set a
+// script is enclosed in braces, so that text appended to the line cannot
+// become part of a trailing comment or command of the script.
+func (c *Cmd) commandLine(group bool) (string, error) {
+	var b strings.Builder
+	if c.Dir != "" {
+		b.WriteString("cd -- " + shellQuote(c.Dir) + " && ")
+	}
+	if len(c.Env) > 0 {
+		b.WriteString("export")
+		for _, kv := range c.Env {
+			i := strings.IndexByte(kv, '=')
+			if i < 0 || !isShellName(kv[:i]) {
+				return "", errors.Errorf("invalid environment variable %q", kv)
+			}
+			b.WriteString(" " + kv[:i] + "=" + shellQuote(kv[i+1:]))
+		}
+		b.WriteString(" && ")
+	}
+	switch {
+	case c.script == "":
+		b.WriteString(c.quotedArgs())
+	case group || b.Len() > 0:
+		// Group the script, also so that the prefix guards all of it. The
+		// newlines end comments and trailing operators.
+		b.WriteString("{\n" + c.script + "\n}")
+	default:
+		b.WriteString(c.script)
+	}
+	return b.String(), nil
+}
+
+// quotedArgs returns Path and Args quoted for the shell.
+func (c *Cmd) quotedArgs() string {
+	words := make([]string, 0, 1+len(c.Args))
+	words = append(words, shellQuote(c.Path))
+	for _, arg := range c.Args {
+		words = append(words, shellQuote(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// name describes the command in errors. Unlike commandLine it leaves out
+// Dir and Env, whose values may be secret.
+func (c *Cmd) name() string {
+	if c.script != "" {
+		return c.script
+	}
+	return c.quotedArgs()
+}
+
+// shellQuote quotes s as a single word for a POSIX shell. Words without
+// characters special to the shell are left as they are. A word with = is
+// quoted, as the shell takes NAME=value as an assignment in command position.
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+			strings.ContainsRune("@%+:,./_-", r)) {
+			// Within single quotes only the quote itself is special, it
+			// is closed, escaped and reopened.
+			return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+		}
 	}
-	copy(buf[:4], fmt.Sprintf("%04x", length))
-	_, err = conn.Write(buf)
-	return err
+	return s
+}
+
+// isShellName reports whether s is a valid shell variable name.
+func isShellName(s string) bool {
+	if s == "" || s[0] >= '0' && s[0] <= '9' {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Cmd) copyOutput(copy func() (int, error)) {
+	c.copyExit, c.copyErr = copy()
+	closeAll(c.closeAfterCopy)
+	close(c.done)
 }
 
 // Start sends command to device.
@@ -66,59 +242,237 @@ func (c *Cmd) Start() error {
 	return c.StartTimeout(time.Time{})
 }
 
-// Wait waits for the servers response.
+// Wait waits for the command to exit and its output to be copied. If it
+// exits with a non-zero code the error is a *ShellExitError.
+// Wait closes the pipes returned by StdinPipe, StdoutPipe and StderrPipe,
+// so it is wrong to call Wait before all reads from them completed.
 func (c *Cmd) Wait() error {
-	if c.conn == nil {
+	return c.WaitContext(context.Background())
+}
+
+// WaitContext is like Wait but stops waiting and closes the connection to
+// the device when ctx is done.
+func (c *Cmd) WaitContext(ctx context.Context) error {
+	if c.done == nil {
 		return errors.New("no command to wait for")
 	}
-	b, err := readBytes(c.conn)
-	if err != nil {
-		return err
-	}
-	// split off exit code
-	var splitter int
-	for i := len(b) - 1; i >= 0; i-- {
-		if b[i] == ':' {
-			splitter = i
-			break
-		}
+	if c.conn == nil {
+		return errors.New("Wait was already called")
 	}
-	c.output = b[:splitter]
-	exitString := string(b[splitter+1:])
-	exitCode, _ := strconv.Atoi(exitString)
-	c.exitCode = exitCode
-	err = c.conn.Close()
-	if err != nil {
-		return err
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		c.conn.Close()
+		// Unblock copying into pipes nobody reads anymore.
+		closeAll(c.closeAfterWait)
+		<-c.done
 	}
+	c.conn.Close()
 	c.conn = nil
+	closeAll(c.closeAfterWait)
+
+	if c.copyErr != nil {
+		return ctxErr(ctx, c.copyErr)
+	}
+	c.exitCode = c.copyExit
+	if c.exitCode != 0 {
+		return &ShellExitError{Command: c.name(), ExitCode: c.exitCode}
+	}
 	return nil
 }
 
-// Run starts and waits for command.
+// Run starts and waits for command. If it exits with a non-zero code the
+// error is a *ShellExitError.
 func (c *Cmd) Run() error {
-	err := c.Start()
+	return c.RunContext(context.Background())
+}
+
+// RunContext is like Run but the command is aborted when ctx is done.
+func (c *Cmd) RunContext(ctx context.Context) error {
+	err := c.StartContext(ctx)
 	if err != nil {
 		return err
 	}
-	return c.Wait()
+	return c.WaitContext(ctx)
 }
 
-// Output returns the output send by the server as reply. Waits if not finished.
+// Output runs the command and returns its standard output. If it exits with
+// a non-zero code and Stderr is not set, the returned *ShellExitError holds
+// the beginning of its error output.
+// Like in os/exec the output is not kept, so Output fails on a command that
+// was already started. Set Stdout before to collect the output of Run.
 func (c *Cmd) Output() ([]byte, error) {
-	if c.output != nil {
-		return c.output, nil
+	return c.OutputContext(context.Background())
+}
+
+// OutputContext is like Output but the command is aborted when ctx is done.
+func (c *Cmd) OutputContext(ctx context.Context) ([]byte, error) {
+	if c.done != nil {
+		return nil, errors.New("Output after command started")
 	}
-	if c.conn != nil {
-		err := c.Wait()
-		if err != nil {
-			return nil, err
-		}
-		return c.output, nil
+	if c.Stdout != nil {
+		return nil, errors.New("Stdout already set")
+	}
+	var stdout bytes.Buffer
+	c.Stdout = &stdout
+
+	var stderr *prefixBuffer
+	if c.Stderr == nil {
+		stderr = &prefixBuffer{max: 64 << 10}
+		c.Stderr = stderr
+	}
+	err := c.RunContext(ctx)
+	if ee, ok := err.(*ShellExitError); ok && stderr != nil {
+		ee.Stderr = stderr.buf
+	}
+	return stdout.Bytes(), err
+}
+
+// CombinedOutput runs the command and returns its standard output and
+// error output combined. Like Output it fails on a command that was already
+// started.
+func (c *Cmd) CombinedOutput() ([]byte, error) {
+	return c.CombinedOutputContext(context.Background())
+}
+
+// CombinedOutputContext is like CombinedOutput but the command is aborted
+// when ctx is done.
+func (c *Cmd) CombinedOutputContext(ctx context.Context) ([]byte, error) {
+	if c.done != nil {
+		return nil, errors.New("CombinedOutput after command started")
+	}
+	if c.Stdout != nil {
+		return nil, errors.New("Stdout already set")
+	}
+	if c.Stderr != nil {
+		return nil, errors.New("Stderr already set")
+	}
+	// Both are written by the same goroutine.
+	var b bytes.Buffer
+	c.Stdout, c.Stderr = &b, &b
+	err := c.RunContext(ctx)
+	return b.Bytes(), err
+}
+
+// StdinPipe returns a pipe that is connected to the input of the command
+// once it starts. Closing the pipe closes the input, Wait closes it as well.
+// It requires shell protocol v2, see FeatureShell2.
+func (c *Cmd) StdinPipe() (io.WriteCloser, error) {
+	if c.Stdin != nil {
+		return nil, errors.New("Stdin already set")
+	}
+	if c.done != nil {
+		return nil, errors.New("StdinPipe after command started")
+	}
+	pr, pw := io.Pipe()
+	c.Stdin = pr
+	c.closeAfterWait = append(c.closeAfterWait, pr)
+	return pw, nil
+}
+
+// StdoutPipe returns a pipe that is connected to the output of the command
+// once it starts. Wait closes the pipe, see Wait.
+func (c *Cmd) StdoutPipe() (io.ReadCloser, error) {
+	if c.Stdout != nil {
+		return nil, errors.New("Stdout already set")
+	}
+	if c.done != nil {
+		return nil, errors.New("StdoutPipe after command started")
+	}
+	pr, pw := io.Pipe()
+	c.Stdout = pw
+	c.closeAfterCopy = append(c.closeAfterCopy, pw)
+	c.closeAfterWait = append(c.closeAfterWait, pr)
+	return pr, nil
+}
+
+// StderrPipe returns a pipe that is connected to the error output of the
+// command once it starts. Wait closes the pipe, see Wait. Devices without
+// shell protocol v2 mix the error output into the standard output.
+func (c *Cmd) StderrPipe() (io.ReadCloser, error) {
+	if c.Stderr != nil {
+		return nil, errors.New("Stderr already set")
+	}
+	if c.done != nil {
+		return nil, errors.New("StderrPipe after command started")
 	}
-	return nil, errors.New("no command to wait for")
+	pr, pw := io.Pipe()
+	c.Stderr = pw
+	c.closeAfterCopy = append(c.closeAfterCopy, pw)
+	c.closeAfterWait = append(c.closeAfterWait, pr)
+	return pr, nil
 }
 
+// ExitCode returns the exit code of the exited command or -1 if it has not
+// exited yet.
 func (c *Cmd) ExitCode() int {
 	return c.exitCode
 }
+
+func closeAll(cc []io.Closer) {
+	for _, c := range cc {
+		c.Close()
+	}
+}
+
+// copyLegacyShell copies the output of a command run by the legacy shell
+// service to w, except for the exit code echoed at its end which is
+// returned.
+func copyLegacyShell(r io.Reader, w io.Writer) (int, error) {
+	ew := &exitCodeWriter{w: w}
+	if _, err := io.Copy(ew, r); err != nil {
+		return -1, err
+	}
+	return ew.exitCode()
+}
+
+// exitCodeWriter holds back the output following the last colon as long
+// as it may be the echoed exit code, e.g. ":1\r\n".
+type exitCodeWriter struct {
+	w    io.Writer
+	tail []byte
+}
+
+// maxExitCodeTail is the length of the longest exit code echoed, ":255\r\n".
+const maxExitCodeTail = 7
+
+func (ew *exitCodeWriter) Write(b []byte) (int, error) {
+	ew.tail = append(ew.tail, b...)
+	keep := bytes.LastIndexByte(ew.tail, ':')
+	if keep < 0 || len(ew.tail)-keep > maxExitCodeTail {
+		keep = len(ew.tail)
+	}
+	if _, err := ew.w.Write(ew.tail[:keep]); err != nil {
+		return 0, err
+	}
+	ew.tail = append(ew.tail[:0], ew.tail[keep:]...)
+	return len(b), nil
+}
+
+func (ew *exitCodeWriter) exitCode() (int, error) {
+	if len(ew.tail) == 0 {
+		return -1, errors.New("shell closed without exit code")
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(string(ew.tail[1:])))
+	if err != nil {
+		return -1, errors.Errorf("malformed exit code %q", ew.tail)
+	}
+	return code, nil
+}
+
+// prefixBuffer keeps the first max bytes written to it and discards the
+// rest.
+type prefixBuffer struct {
+	buf []byte
+	max int
+}
+
+func (b *prefixBuffer) Write(p []byte) (int, error) {
+	if n := b.max - len(b.buf); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		b.buf = append(b.buf, p[:n]...)
+	}
+	return len(p), nil
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -20,12 +23,27 @@ const StdIoFilename = "-"
 var (
 	serial = kingpin.Flag("serial", "Connect to device by serial number.").
 		Short('s').
+		Envar(adb.EnvSerial).
 		String()
+	usbFlag = kingpin.Flag("usb", "Use the only device connected via USB.").
+		Short('d').
+		Bool()
+	localFlag = kingpin.Flag("emulator", "Use the only device connected via TCP or emulator.").
+			Short('e').
+			Bool()
+	transportID = kingpin.Flag("transport-id", "Connect to device by transport id.").
+			Short('t').
+			Int64()
 
 	shellCommand    = kingpin.Command("shell", "Run a shell command on the device.")
 	shellCommandArg = shellCommand.Arg("command", "Command to run on device.").
 			Strings()
 
+	execOutCommand    = kingpin.Command("exec-out", "Run a command on the device without a PTY and copy its raw output.")
+	execOutCommandArg = execOutCommand.Arg("command", "Command to run on device.").
+				Required().
+				Strings()
+
 	devicesCommand  = kingpin.Command("devices", "List devices.")
 	devicesLongFlag = devicesCommand.Flag("long", "Include extra detail about devices.").
 			Short('l').
@@ -76,15 +94,20 @@ func main() {
 	case "devices":
 		err = listDevices(client, *devicesLongFlag)
 	case "shell":
-		err = runShellCommand(client, *shellCommandArg, *serial)
+		err = runShellCommand(client, *shellCommandArg)
+	case "exec-out":
+		err = execOut(client, *execOutCommandArg)
 	case "pull":
-		err = pull(client, *pullProgressFlag, *pullRemoteArg, *pullLocalArg, *serial)
+		err = pull(client, *pullProgressFlag, *pullRemoteArg, *pullLocalArg)
 	case "push":
-		err = push(client, *pushProgressFlag, *pushLocalArg, *pushRemoteArg, *serial)
+		err = push(client, *pushProgressFlag, *pushLocalArg, *pushRemoteArg)
 	case "forward":
-		err = forward(client, *forwardListFlag, *serial)
+		err = forward(client, *forwardListFlag)
 	}
 
+	if ee, ok := errors.Cause(err).(*adb.ShellExitError); ok {
+		os.Exit(ee.ExitCode)
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error:", err)
 		os.Exit(1)
@@ -98,47 +121,121 @@ func listDevices(client *adb.Server, long bool) error {
 		return err
 	}
 
+	if long {
+		fmt.Print(adb.FormatDeviceInfo(devices))
+		return nil
+	}
 	for _, device := range devices {
-		if long {
-			if !device.IsUSB() {
-				fmt.Printf("%s\tproduct:%s model:%s device:%s\n",
-					device.Serial, device.Product, device.Model, device)
-			} else {
-				fmt.Printf("%s\tusb:%s product:%s model:%s device:%s\n",
-					device.Serial, device.USB, device.Product, device.Model, device)
-			}
-		} else {
-			fmt.Println(device.Serial)
-		}
+		fmt.Printf("%s\t%s\n", device.Serial, device.RawState)
 	}
 
 	return nil
 }
 
-func runShellCommand(client *adb.Server, commandAndArgs []string, deviceSerial string) error {
-	if len(commandAndArgs) == 0 {
-		return userError{fmt.Errorf("no command")}
+// selectDevice returns the device selected by the command line flags.
+func selectDevice(client *adb.Server) (*adb.Device, error) {
+	var device *adb.Device
+	switch {
+	case *transportID != 0:
+		device = client.DeviceByTransportID(*transportID)
+	case *usbFlag:
+		device = client.USBDevice()
+	case *localFlag:
+		device = client.LocalDevice()
+	default:
+		device = client.Device(*serial)
+	}
+	if device == nil {
+		return nil, fmt.Errorf("device not found")
 	}
+	return device, nil
+}
 
-	command := commandAndArgs[0]
-	var args []string
+func runShellCommand(client *adb.Server, commandAndArgs []string) error {
+	if len(commandAndArgs) == 0 {
+		if !isTerminal(int(os.Stdin.Fd())) {
+			return userError{fmt.Errorf("no command")}
+		}
+		device, err := selectDevice(client)
+		if err != nil {
+			return err
+		}
+		return interactiveShell(device)
+	}
 
-	if len(commandAndArgs) > 1 {
-		args = commandAndArgs[1:]
+	device, err := selectDevice(client)
+	if err != nil {
+		return err
 	}
+	// Like adb, pass the arguments on to the device shell as they are, so
+	// that pipes and redirections work.
+	cmd := device.Script(strings.Join(commandAndArgs, " "))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
 
-	device := client.Device(deviceSerial)
-	output, err := device.Command(command, args...).Output()
+// interactiveShell runs a login shell on the device in the terminal of
+// stdin, like adb shell without a command.
+func interactiveShell(device *adb.Device) error {
+	fd := int(os.Stdin.Fd())
+	opts := adb.ShellOptions{
+		Term:   os.Getenv("TERM"),
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+	}
+	opts.Rows, opts.Cols, _ = windowSize(fd)
+	session, err := device.Shell(context.Background(), opts)
+	if err != nil {
+		return err
+	}
+	restore, err := makeRaw(fd)
 	if err != nil {
+		session.Close()
 		return err
 	}
+	defer restore()
+
+	resized := make(chan os.Signal, 1)
+	notifyResize(resized)
+	defer signal.Stop(resized)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-resized:
+				if rows, cols, err := windowSize(fd); err == nil {
+					session.Resize(rows, cols)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return session.Wait()
+}
 
-	fmt.Print(output)
-	return nil
+func execOut(client *adb.Server, commandAndArgs []string) error {
+	device, err := selectDevice(client)
+	if err != nil {
+		return err
+	}
+	// Like adb, pass the arguments on to the device shell as they are.
+	out, err := device.ExecScript(context.Background(), nil, strings.Join(commandAndArgs, " "))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(os.Stdout, out)
+	return err
 }
 
-func forward(client *adb.Server, listForwards bool, deviceSerial string) error {
-	device := client.Device(deviceSerial)
+func forward(client *adb.Server, listForwards bool) error {
+	device, err := selectDevice(client)
+	if err != nil {
+		return err
+	}
 	fws, err := device.ForwardList()
 	if err != nil {
 		return err
@@ -149,7 +246,7 @@ func forward(client *adb.Server, listForwards bool, deviceSerial string) error {
 	return nil
 }
 
-func pull(client *adb.Server, showProgress bool, remotePath, localPath string, deviceSerial string) error {
+func pull(client *adb.Server, showProgress bool, remotePath, localPath string) error {
 	if remotePath == "" {
 		return userError{fmt.Errorf("must specify remote file")}
 	}
@@ -158,7 +255,10 @@ func pull(client *adb.Server, showProgress bool, remotePath, localPath string, d
 		localPath = filepath.Base(remotePath)
 	}
 
-	device := client.Device(deviceSerial)
+	device, err := selectDevice(client)
+	if err != nil {
+		return err
+	}
 
 	info, err := device.Stat(remotePath)
 	if _, ok := errors.Cause(err).(*os.PathError); ok {
@@ -190,7 +290,7 @@ func pull(client *adb.Server, showProgress bool, remotePath, localPath string, d
 	return nil
 }
 
-func push(client *adb.Server, showProgress bool, localPath, remotePath string, deviceSerial string) error {
+func push(client *adb.Server, showProgress bool, localPath, remotePath string) error {
 	if remotePath == "" {
 		return userError{fmt.Errorf("must specify remote file")}
 	}
@@ -222,7 +322,10 @@ func push(client *adb.Server, showProgress bool, localPath, remotePath string, d
 	}
 	defer localFile.Close()
 
-	device := client.Device(deviceSerial)
+	device, err := selectDevice(client)
+	if err != nil {
+		return err
+	}
 	writer, err := device.OpenWrite(remotePath, perms, mtime)
 	if err != nil {
 		return fmt.Errorf("failed opening remote file %s: %v", remotePath, err)
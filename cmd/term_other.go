@@ -0,0 +1,25 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoTerminal = errors.New("terminal not supported on this platform")
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (restore func(), err error) {
+	return nil, errNoTerminal
+}
+
+func windowSize(fd int) (rows, cols int, err error) {
+	return 0, 0, errNoTerminal
+}
+
+func notifyResize(c chan<- os.Signal) {}
@@ -0,0 +1,132 @@
+package adb
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultDevicePort is the port adbd listens on for TCP connections.
+const DefaultDevicePort = 5555
+
+// ConnectResult is the outcome of a successful Connect.
+type ConnectResult struct {
+	// Address of the device as reported by the server.
+	Address string
+	// AlreadyConnected is true if the server was already connected to the
+	// device.
+	AlreadyConnected bool
+}
+
+// PairResult is the outcome of a successful Pair.
+type PairResult struct {
+	// Address of the device as reported by the server.
+	Address string
+	// GUID of the paired device. Can be empty on older servers.
+	GUID string
+}
+
+// Connect tells the server to connect to a device listening on host:port
+// via TCP. If port is 0 DefaultDevicePort is used.
+func (s *Server) Connect(host string, port int) (ConnectResult, error) {
+	return s.ConnectContext(context.Background(), host, port)
+}
+
+// ConnectContext is like Connect but aborts when ctx is done.
+func (s *Server) ConnectContext(ctx context.Context, host string, port int) (ConnectResult, error) {
+	if port == 0 {
+		port = DefaultDevicePort
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	b, err := s.requestResponseBytes(ctx, "connect:"+address)
+	if err != nil {
+		return ConnectResult{}, errors.WithMessage(err, "Connect")
+	}
+	return parseConnectResult(address, string(b))
+}
+
+// Disconnect tells the server to disconnect from the TCP device at addr,
+// given as host:port or host.
+func (s *Server) Disconnect(addr string) error {
+	return s.DisconnectContext(context.Background(), addr)
+}
+
+// DisconnectContext is like Disconnect but aborts when ctx is done.
+func (s *Server) DisconnectContext(ctx context.Context, addr string) error {
+	if addr == "" {
+		return errors.New("Disconnect: empty address")
+	}
+	return s.disconnect(ctx, addr)
+}
+
+// DisconnectAll tells the server to disconnect from all TCP devices.
+func (s *Server) DisconnectAll() error {
+	return s.DisconnectAllContext(context.Background())
+}
+
+// DisconnectAllContext is like DisconnectAll but aborts when ctx is done.
+func (s *Server) DisconnectAllContext(ctx context.Context) error {
+	return s.disconnect(ctx, "")
+}
+
+func (s *Server) disconnect(ctx context.Context, addr string) error {
+	b, err := s.requestResponseBytes(ctx, "disconnect:"+addr)
+	if err != nil {
+		return errors.WithMessage(err, "Disconnect")
+	}
+	if msg := string(b); !strings.HasPrefix(msg, "disconnected") {
+		return &ConnectError{"disconnect", addr, msg}
+	}
+	return nil
+}
+
+// Pair pairs the server with a device using the Android 11+ wireless
+// debugging pairing code shown on the device. addr is the pairing address
+// given as host:port, which differs from the address to connect to.
+func (s *Server) Pair(code, addr string) (PairResult, error) {
+	return s.PairContext(context.Background(), code, addr)
+}
+
+// PairContext is like Pair but aborts when ctx is done.
+func (s *Server) PairContext(ctx context.Context, code, addr string) (PairResult, error) {
+	b, err := s.requestResponseBytes(ctx, "pair:"+code+":"+addr)
+	if err != nil {
+		return PairResult{}, errors.WithMessage(err, "Pair")
+	}
+	return parsePairResult(addr, string(b))
+}
+
+// parseConnectResult interprets the human readable reply of host:connect.
+func parseConnectResult(address, msg string) (ConnectResult, error) {
+	msg = strings.TrimSpace(msg)
+	switch {
+	case strings.HasPrefix(msg, "already connected to "):
+		return ConnectResult{
+			Address:          strings.TrimPrefix(msg, "already connected to "),
+			AlreadyConnected: true,
+		}, nil
+	case strings.HasPrefix(msg, "connected to "):
+		return ConnectResult{Address: strings.TrimPrefix(msg, "connected to ")}, nil
+	default:
+		// e.g. "failed to connect to ...", "failed to authenticate to ..."
+		return ConnectResult{}, &ConnectError{"connect", address, msg}
+	}
+}
+
+// parsePairResult interprets the human readable reply of host:pair, which
+// looks like "Successfully paired to <addr> [guid=<guid>]" on success.
+func parsePairResult(address, msg string) (PairResult, error) {
+	msg = strings.TrimSpace(msg)
+	if !strings.HasPrefix(msg, "Successfully paired to ") {
+		return PairResult{}, &ConnectError{"pair", address, msg}
+	}
+	res := PairResult{Address: strings.TrimPrefix(msg, "Successfully paired to ")}
+	if i := strings.Index(res.Address, " [guid="); i >= 0 {
+		res.GUID = strings.TrimSuffix(res.Address[i+len(" [guid="):], "]")
+		res.Address = res.Address[:i]
+	}
+	return res, nil
+}
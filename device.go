@@ -1,16 +1,38 @@
 package adb
 
 import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+
 	"github.com/pkg/errors"
 )
 
 // Device communicates with a specific Android device.
-// To get an instance, call Server.Device(serial).
+// To get an instance, call Server.Device(serial), Server.DeviceByTransportID,
+// Server.USBDevice or Server.LocalDevice.
 type Device struct {
 	server *Server
 	serial string
+
+	// Requests are routed by transportID if set, by kind otherwise.
+	transportID int64
+	kind        transportKind
+
+	mu       sync.Mutex
+	features FeatureSet // cached, see FeaturesContext
 }
 
+// transportKind selects how a device is addressed if it has no transport id.
+type transportKind uint8
+
+const (
+	kindSerial transportKind = iota
+	kindUSB
+	kindLocal
+)
+
 // String returns the devices serial-number.
 func (d *Device) String() string {
 	// return d.descriptor.String()
@@ -18,38 +40,98 @@ func (d *Device) String() string {
 	return d.serial
 }
 
+// TransportID returns the transport id the device is addressed by, or 0 if
+// it is addressed otherwise.
+func (d *Device) TransportID() int64 {
+	return d.transportID
+}
+
+// hostPrefix returns the prefix of host requests targeted at d.
+func (d *Device) hostPrefix() string {
+	switch {
+	case d.transportID != 0:
+		return "host-transport-id:" + strconv.FormatInt(d.transportID, 10) + ":"
+	case d.kind == kindUSB:
+		return "host-usb:"
+	case d.kind == kindLocal:
+		return "host-local:"
+	default:
+		return "host-serial:" + d.serial + ":"
+	}
+}
+
+// transportRequest returns the host request switching a connection to d.
+func (d *Device) transportRequest() string {
+	switch {
+	case d.transportID != 0:
+		return "host:transport-id:" + strconv.FormatInt(d.transportID, 10)
+	case d.kind == kindUSB:
+		return "host:transport-usb"
+	case d.kind == kindLocal:
+		return "host:transport-local"
+	default:
+		return "host:transport:" + d.serial
+	}
+}
+
 // getAttribute returns the message send by the server when requesting
 // <host-prefix>:<attr>, where host-prefix is d.
-func (d *Device) requestResponseString(attr string) ([]byte, error) {
-	return requestResponseBytes(d.server.address, "host-serial:"+d.serial+":"+attr)
+func (d *Device) requestResponseString(ctx context.Context, attr string) ([]byte, error) {
+	return requestResponseBytes(ctx, d.server, d.hostPrefix()+attr)
+}
+
+func (d *Device) send(ctx context.Context, attr string) error {
+	return send(ctx, d.server, d.hostPrefix()+attr)
 }
 
-func (d *Device) send(attr string) error {
-	return send(d.server.address, "host-serial:"+d.serial+":"+attr)
+// OpenService connects to service on the device, e.g. "shell:ls" or
+// "track-jdwp", and returns the raw stream after the device accepted it.
+// Use it for services this package does not wrap, together with ReadMessage
+// and ReadResponse. The returned connection is closed when ctx is done.
+func (d *Device) OpenService(ctx context.Context, service string) (net.Conn, error) {
+	conn, err := d.server.OpenService(ctx, d.transportRequest())
+	if err != nil {
+		return nil, err
+	}
+	err = sendMessage(conn, service)
+	if err == nil {
+		err = wantStatus(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, ctxErr(ctx, err)
+	}
+	return conn, nil
 }
 
 // get-product is documented, but not implemented, in the server.
 // TODO(z): Make product exported if get-product is ever implemented in adb.
 func (d *Device) product() (string, error) {
-	attr, err := d.requestResponseString("get-product")
+	attr, err := d.requestResponseString(context.Background(), "get-product")
 	return string(attr), errors.WithMessage(err, "Product")
 }
 
 // Serial returns the devices serial number.
 // unnecessary?!
 func (d *Device) Serial() (string, error) {
-	attr, err := d.requestResponseString("get-serialno")
+	attr, err := d.requestResponseString(context.Background(), "get-serialno")
 	return string(attr), errors.WithMessage(err, "Serial")
 }
 
 // DevicePath returns the current devices path.
 func (d *Device) DevicePath() (string, error) {
-	attr, err := d.requestResponseString("get-devpath")
+	attr, err := d.requestResponseString(context.Background(), "get-devpath")
 	return string(attr), errors.WithMessage(err, "DevicePath")
 }
 
+// State returns the current state of the device as reported by the server.
 func (d *Device) State() (DeviceState, error) {
-	attr, err := d.requestResponseString("get-state")
+	return d.StateContext(context.Background())
+}
+
+// StateContext is like State but aborts when ctx is done.
+func (d *Device) StateContext(ctx context.Context) (DeviceState, error) {
+	attr, err := d.requestResponseString(ctx, "get-state")
 	state := parseDeviceState(string(attr))
 	return state, errors.WithMessage(err, "State")
 }
@@ -65,7 +147,9 @@ func (d *Device) DeviceInfo() (DeviceInfo, error) {
 	}
 
 	for _, deviceInfo := range devices {
-		if deviceInfo.Serial == d.serial {
+		if d.transportID != 0 && deviceInfo.TransportID == d.transportID ||
+			d.transportID == 0 && deviceInfo.Serial == d.serial {
+
 			return deviceInfo, nil
 		}
 	}
@@ -85,6 +169,6 @@ TODO(jmh): actually use this!
 TODO(jmh): investigate respnse type
 */
 func (d *Device) remount() error {
-	_, err := d.requestResponseString("remount")
+	_, err := d.requestResponseString(context.Background(), "remount")
 	return errors.WithMessage(err, "Remount")
 }
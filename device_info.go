@@ -4,20 +4,33 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
 )
 
+// DeviceInfo describes a device as listed by the server.
 type DeviceInfo struct {
 	// Must be always set.
 	Serial string
+	// State is the parsed state of the device. RawState holds the state as
+	// reported by the server, which can carry extra information, e.g.
+	// "no permissions (missing udev rules?...)".
+	State    DeviceState
+	RawState string
 	// Product, device, and model are not set in the short form.
 	Product string
 	Model   string
 	Device  string
 	// Only set for devices connected via USB.
 	USB string
+	// TransportID uniquely identifies the connection to the device.
+	// Zero if not reported by the server.
+	TransportID int64
+	// Extra holds all other key:value pairs reported by the server.
+	Extra map[string]string
 }
 
 // IsUSB returns true if the device is connected via USB.
@@ -26,12 +39,55 @@ func (d DeviceInfo) IsUSB() bool {
 	return d.USB != ""
 }
 
+// Equal reports whether d and o hold the same information.
+func (d DeviceInfo) Equal(o DeviceInfo) bool {
+	if d.Serial != o.Serial || d.State != o.State || d.RawState != o.RawState ||
+		d.Product != o.Product || d.Model != o.Model || d.Device != o.Device ||
+		d.USB != o.USB || d.TransportID != o.TransportID ||
+		len(d.Extra) != len(o.Extra) {
+
+		return false
+	}
+	for k, v := range d.Extra {
+		if ov, ok := o.Extra[k]; !ok || ov != v {
+			return false
+		}
+	}
+	return true
+}
+
+// FormatDeviceInfo formats dd the same way the server does for devices -l,
+// one device per line. The result can be parsed again.
 func FormatDeviceInfo(dd []DeviceInfo) string {
 	f := new(strings.Builder)
-	fmt.Fprintln(f, "Serial Product Model Device USB")
 	for _, d := range dd {
-		fmt.Fprintf(f, "%6s %7s %5s %6s %3s\n",
-			d.Serial, d.Product, d.Model, d.Device, d.USB)
+		state := d.RawState
+		if state == "" {
+			state = formatDeviceState(d.State)
+		}
+		fmt.Fprintf(f, "%-22s %s", d.Serial, state)
+		for _, kv := range [...][2]string{
+			{"usb", d.USB},
+			{"product", d.Product},
+			{"model", d.Model},
+			{"device", d.Device},
+		} {
+			if kv[1] != "" {
+				fmt.Fprintf(f, " %s:%s", kv[0], kv[1])
+			}
+		}
+		if d.TransportID != 0 {
+			fmt.Fprintf(f, " transport_id:%d", d.TransportID)
+		}
+		keys := make([]string, 0, len(d.Extra))
+		for k := range d.Extra {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(f, " %s:%s", k, d.Extra[k])
+		}
+		fmt.Fprintln(f)
 	}
 	return f.String()
 }
@@ -41,6 +97,9 @@ func parseDeviceList(list io.Reader, lineParseFunc func(string) (DeviceInfo, err
 	scanner := bufio.NewScanner(list)
 
 	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
 		device, err := lineParseFunc(scanner.Text())
 		if err != nil {
 			return nil, err
@@ -51,28 +110,52 @@ func parseDeviceList(list io.Reader, lineParseFunc func(string) (DeviceInfo, err
 	return devices, nil
 }
 
+// parseDeviceShort parses a line of the devices list: "<serial>\t<state>".
 func parseDeviceShort(line string) (DeviceInfo, error) {
-	fields := strings.Fields(line)
-	if len(fields) != 2 {
-		return DeviceInfo{}, errors.Errorf(
-			"malformed device line, expected 2 fields but found %d", len(fields))
+	var serial, state string
+	if i := strings.IndexByte(line, '\t'); i >= 0 {
+		serial, state = line[:i], strings.TrimSpace(line[i+1:])
+	} else {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return DeviceInfo{}, errors.Errorf(
+				"malformed device line, expected 2 fields but found %d", len(fields))
+		}
+		serial, state = fields[0], fields[1]
+	}
+	if serial == "" || state == "" {
+		return DeviceInfo{}, errors.Errorf("malformed device line: %q", line)
 	}
-	return DeviceInfo{Serial: fields[0]}, nil
+	return DeviceInfo{
+		Serial:   serial,
+		State:    parseDeviceState(state),
+		RawState: state,
+	}, nil
 }
 
+// parseDeviceLong parses a line of the devices -l list:
+// "<serial> <state> [<key>:<value>...]". The state may contain spaces.
 func parseDeviceLong(line string) (DeviceInfo, error) {
 	fields := strings.Fields(line)
-	if len(fields) < 5 {
+	if len(fields) < 2 {
 		return DeviceInfo{}, errors.Errorf(
-			"malformed device line, expected at least 5 fields but found %d", len(fields))
+			"malformed device line, expected at least 2 fields but found %d", len(fields))
 	}
-	di := DeviceInfo{Serial: fields[0]}
-	for _, field := range fields[2:] {
-		split := strings.Split(field, ":")
-		if len(split) != 2 {
-			continue
-		}
-		switch s := split[1]; split[0] {
+	// Properties are trailing key:value pairs, everything in between
+	// belongs to the state.
+	end := len(fields)
+	for end > 2 && isDeviceProperty(fields[end-1]) {
+		end--
+	}
+	state := strings.Join(fields[1:end], " ")
+	di := DeviceInfo{
+		Serial:   fields[0],
+		State:    parseDeviceState(state),
+		RawState: state,
+	}
+	for _, field := range fields[end:] {
+		i := strings.IndexByte(field, ':')
+		switch k, s := field[:i], field[i+1:]; k {
 		case "product":
 			di.Product = s
 		case "model":
@@ -81,7 +164,29 @@ func parseDeviceLong(line string) (DeviceInfo, error) {
 			di.Device = s
 		case "usb":
 			di.USB = s
+		case "transport_id":
+			di.TransportID, _ = strconv.ParseInt(s, 10, 64)
+		default:
+			if di.Extra == nil {
+				di.Extra = make(map[string]string)
+			}
+			di.Extra[k] = s
 		}
 	}
 	return di, nil
 }
+
+// isDeviceProperty reports whether field looks like a key:value pair of a
+// device list, the key consisting of lower case letters and underscores.
+func isDeviceProperty(field string) bool {
+	i := strings.IndexByte(field, ':')
+	if i <= 0 {
+		return false
+	}
+	for _, r := range field[:i] {
+		if (r < 'a' || r > 'z') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
@@ -1,19 +1,22 @@
 package adb
 
 import (
-	"bufio"
 	"bytes"
-	"fmt"
-	"io"
+	"context"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
-// DeviceState represents one of the 3 possible states adb will report devices.
-// A device can be communicated with when it's in StateOnline.
+// DeviceState represents one of the states adb will report devices in.
+// A device can be communicated with when it's in StateOnline, StateRecovery,
+// StateRescue or StateSideload, depending on the service.
 // A USB device will make the following state transitions:
 //
 //     Plugged in: StateDisconnected->StateOffline->StateOnline
@@ -29,30 +32,101 @@ const (
 	StateDisconnected
 	StateOffline
 	StateOnline
+	StateBootloader
+	StateRecovery
+	StateRescue
+	StateSideload
+	StateAuthorizing
+	StateConnecting
+	StateHost
+	StateNoPermissions
+	StateDetached
 )
 
 func parseDeviceState(str string) DeviceState {
+	if strings.HasPrefix(str, "no permissions") {
+		// Followed by a hint on how to fix it.
+		return StateNoPermissions
+	}
 	switch str {
-	case "":
-		return StateDisconnected
 	case "offline":
 		return StateOffline
 	case "device":
 		return StateOnline
 	case "unauthorized":
 		return StateUnauthorized
+	case "bootloader":
+		return StateBootloader
+	case "recovery":
+		return StateRecovery
+	case "rescue":
+		return StateRescue
+	case "sideload":
+		return StateSideload
+	case "authorizing":
+		return StateAuthorizing
+	case "connecting":
+		return StateConnecting
+	case "host":
+		return StateHost
+	case "detached":
+		return StateDetached
 	default:
 		return StateInvalid
 	}
 }
 
+// formatDeviceState returns state as reported by the server.
+func formatDeviceState(state DeviceState) string {
+	switch state {
+	case StateOffline:
+		return "offline"
+	case StateOnline:
+		return "device"
+	case StateUnauthorized:
+		return "unauthorized"
+	case StateBootloader:
+		return "bootloader"
+	case StateRecovery:
+		return "recovery"
+	case StateRescue:
+		return "rescue"
+	case StateSideload:
+		return "sideload"
+	case StateAuthorizing:
+		return "authorizing"
+	case StateConnecting:
+		return "connecting"
+	case StateHost:
+		return "host"
+	case StateNoPermissions:
+		return "no permissions"
+	case StateDetached:
+		return "detached"
+	default:
+		return "unknown"
+	}
+}
+
 // DeviceStateChangedEvent represents a device state transition.
 // Contains the device’s old and new states, but also provides methods to
 // query the type of state transition.
+// Watchers in long mode also report the full device info and changes to it
+// that leave the state untouched.
 type DeviceStateChangedEvent struct {
 	Serial   string
 	OldState DeviceState
 	NewState DeviceState
+
+	// Old and New are only set by watchers in long mode.
+	Old DeviceInfo
+	New DeviceInfo
+}
+
+// StateChanged returns true if the state of the device changed. It is
+// false for events that only report changed device info.
+func (e DeviceStateChangedEvent) StateChanged() bool {
+	return e.OldState != e.NewState
 }
 
 // CameOnline returns true if this event represents a device coming online.
@@ -65,46 +139,166 @@ func (e DeviceStateChangedEvent) WentOffline() bool {
 	return e.OldState == StateOnline && e.NewState != StateOnline
 }
 
+// Entered returns true if this event represents a device entering state.
+func (e DeviceStateChangedEvent) Entered(state DeviceState) bool {
+	return e.OldState != state && e.NewState == state
+}
+
+// Left returns true if this event represents a device leaving state.
+func (e DeviceStateChangedEvent) Left(state DeviceState) bool {
+	return e.OldState == state && e.NewState != state
+}
+
+// EnteredRecovery returns true if this event represents a device booting
+// into recovery.
+func (e DeviceStateChangedEvent) EnteredRecovery() bool {
+	return e.Entered(StateRecovery)
+}
+
+// EnteredBootloader returns true if this event represents a device
+// rebooting into the bootloader.
+func (e DeviceStateChangedEvent) EnteredBootloader() bool {
+	return e.Entered(StateBootloader)
+}
+
+// EnteredSideload returns true if this event represents a device entering
+// sideload mode.
+func (e DeviceStateChangedEvent) EnteredSideload() bool {
+	return e.Entered(StateSideload)
+}
+
+// EnteredRescue returns true if this event represents a device entering
+// rescue mode.
+func (e DeviceStateChangedEvent) EnteredRescue() bool {
+	return e.Entered(StateRescue)
+}
+
+// Disconnected returns true if this event represents a device vanishing
+// from the device list.
+func (e DeviceStateChangedEvent) Disconnected() bool {
+	return e.Entered(StateDisconnected)
+}
+
+// NeedsAttention returns true if this event represents a device entering a
+// state that requires user interaction, like accepting the RSA key or
+// fixing USB permissions.
+func (e DeviceStateChangedEvent) NeedsAttention() bool {
+	return e.Entered(StateUnauthorized) || e.Entered(StateNoPermissions)
+}
+
 // DeviceWatcher publishes device status change events.
-// If the server dies while listening for events, it restarts the server.
+// If the connection to the server is lost, e.g. because the server died,
+// all known devices are reported as disconnected. The watcher then
+// restarts the server, unless disabled, and reconnects with exponential
+// backoff until it succeeds or it is closed.
+//
+// Events can be received by any number of subscribers, see Subscribe.
 type DeviceWatcher struct {
-	server    *Server
-	conn      net.Conn
-	err       atomic.Value
-	eventChan chan DeviceStateChangedEvent
-	cancel    chan struct{}
+	server *Server
+	conn   net.Conn
+	opts   DeviceWatcherOptions
+	err    atomic.Value
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu      sync.Mutex
+	known   map[deviceKey]DeviceInfo // guarded by mu
+	subs    []*Subscription          // guarded by mu
+	stopped bool                     // guarded by mu
+
+	legacyOnce sync.Once
+	legacy     *Subscription // see C
+}
+
+// DeviceWatcherOptions configures a DeviceWatcher created by
+// NewDeviceWatcherWithOptions.
+type DeviceWatcherOptions struct {
+	// Long makes the watcher report the full DeviceInfo of devices. Events
+	// are also published when only the info of a device changes, e.g. when
+	// it moves to another USB port.
+	Long bool
+
+	// MinBackoff and MaxBackoff bound the delay between attempts to
+	// reconnect to the server. Default to 100 milliseconds and 30 seconds.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
 }
 
 // NewDeviceWatcher starts a new device watcher.
 func (s *Server) NewDeviceWatcher() (*DeviceWatcher, error) {
-	conn, err := dial(s.address)
-	if err != nil {
-		return nil, err
-	}
-	_, err = conn.Write([]byte("host:track-devices"))
-	if err != nil {
-		conn.Close()
-		return nil, err
+	return s.NewDeviceWatcherContext(context.Background())
+}
+
+// NewDeviceWatcherContext starts a new device watcher that stops when ctx is
+// done. In this case Err reports ctx.Err().
+func (s *Server) NewDeviceWatcherContext(ctx context.Context) (*DeviceWatcher, error) {
+	return s.NewDeviceWatcherWithOptions(ctx, DeviceWatcherOptions{})
+}
+
+// NewDeviceWatcherWithOptions is like NewDeviceWatcherContext but configured
+// by opts. The initial connection to the server is made before it returns,
+// failing to establish it is reported as an error.
+func (s *Server) NewDeviceWatcherWithOptions(ctx context.Context, opts DeviceWatcherOptions) (*DeviceWatcher, error) {
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = 100 * time.Millisecond
 	}
-	if err := wantStatus(conn); err != nil {
-		conn.Close()
-		return nil, err
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = 30 * time.Second
 	}
-
+	ctx, cancel := context.WithCancel(ctx)
 	watcher := &DeviceWatcher{
-		server:    s,
-		eventChan: make(chan DeviceStateChangedEvent, 1),
-		cancel:    make(chan struct{}),
-		conn:      conn,
+		server: s,
+		opts:   opts,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		known:  make(map[deviceKey]DeviceInfo),
 	}
+	conn, err := watcher.connect()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	watcher.conn = conn
 	go publishDevices(watcher)
 	return watcher, nil
 }
 
 // C returns a channel than can be received on to get events.
 // If an unrecoverable error occurs, or Shutdown is called, the channel will be closed.
+//
+// The channel is subscribed on the first call. It starts with an event for
+// every device known at that time, as if it had just connected.
+// Like a Subscription with the default options it buffers 16 events, a
+// receiver that falls behind loses the oldest ones. Use Subscribe to
+// choose a different policy.
 func (w *DeviceWatcher) C() <-chan DeviceStateChangedEvent {
-	return w.eventChan
+	w.legacyOnce.Do(func() {
+		w.legacy = w.subscribe(SubscribeOptions{}, true)
+	})
+	return w.legacy.C()
+}
+
+// Snapshot returns the current state of all known devices by serial.
+// Of devices sharing a serial the one with the latest transport is included.
+// Use Subscription.Snapshot for a view consistent with its events.
+func (w *DeviceWatcher) Snapshot() map[string]DeviceState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.snapshot()
+}
+
+// snapshot must be called with w.mu held.
+func (w *DeviceWatcher) snapshot() map[string]DeviceState {
+	m := make(map[string]DeviceState, len(w.known))
+	latest := make(map[string]int64, len(w.known))
+	for key, di := range w.known {
+		if id, ok := latest[key.serial]; !ok || key.transportID > id {
+			m[key.serial], latest[key.serial] = di.State, key.transportID
+		}
+	}
+	return m
 }
 
 // Err returns the error that caused the channel returned by C to be closed,
@@ -115,111 +309,242 @@ func (w *DeviceWatcher) Err() error {
 }
 
 // Close stops the watcher from listening for events and closes the channel
-// returned from C. Don't double close a DeviceWatcher.
+// returned from C. It does not wait for pending events to be received.
 func (w *DeviceWatcher) Close() error {
-	w.cancel <- struct{}{}
-	<-w.cancel
+	w.cancel()
+	<-w.done
 	err, _ := w.err.Load().(error)
+	if err == context.Canceled {
+		return nil
+	}
 	return err
 }
 
+// connect opens a track-devices connection to the server.
+func (w *DeviceWatcher) connect() (net.Conn, error) {
+	conn, err := w.server.dialContext(w.ctx)
+	if err != nil {
+		return nil, err
+	}
+	service := "host:track-devices"
+	if w.opts.Long {
+		service = "host:track-devices-l"
+	}
+	err = sendMessage(conn, service)
+	if err == nil {
+		err = wantStatus(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, ctxErr(w.ctx, err)
+	}
+	return conn, nil
+}
+
+// reconnect restarts the server and redials it with exponential backoff
+// until it succeeds or the watcher is closed.
+func (w *DeviceWatcher) reconnect() (net.Conn, error) {
+	backoff := w.opts.MinBackoff
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-w.ctx.Done():
+			return nil, w.ctx.Err()
+		}
+		// Errors are ignored, the server might be started by someone else.
+		start(w.ctx, w.server)
+		conn, err := w.connect()
+		if err == nil {
+			return conn, nil
+		} else if w.ctx.Err() != nil {
+			return nil, w.ctx.Err()
+		}
+		backoff *= 2
+		if backoff > w.opts.MaxBackoff {
+			backoff = w.opts.MaxBackoff
+		}
+		timer.Reset(backoff)
+	}
+}
+
+// update publishes the changes from the known devices to list to all
+// subscribers. It returns false if the watcher was closed meanwhile.
+func (w *DeviceWatcher) update(list []DeviceInfo) bool {
+	// Subscribers added after the update see it in their snapshot, so they
+	// must not get its events.
+	w.mu.Lock()
+	events := diffDevices(w.known, list, w.opts.Long)
+	subs := append([]*Subscription(nil), w.subs...)
+	w.mu.Unlock()
+
+	// A blocking subscriber must not hold up Snapshot, Subscribe or Close.
+	for _, ev := range events {
+		for _, sub := range subs {
+			sub.publish(ev)
+		}
+		if w.ctx.Err() != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// stop closes all subscriptions.
+func (w *DeviceWatcher) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stopped = true
+	for _, sub := range w.subs {
+		sub.close()
+	}
+	w.subs = nil
+}
+
 func publishDevices(dw *DeviceWatcher) {
-	defer func() {
-		err := dw.conn.Close()
-		if err != nil && dw.err.Load() == nil {
+	defer close(dw.done)
+	defer dw.cancel()
+	defer dw.stop()
+
+	parse := parseDeviceShort
+	if dw.opts.Long {
+		parse = parseDeviceLong
+	}
+	for {
+		err := trackDevices(dw, parse)
+		dw.conn.Close()
+		if dw.ctx.Err() != nil {
+			dw.err.Store(dw.ctx.Err())
+			return
+		} else if err != errConnectionLost {
 			dw.err.Store(err)
+			return
 		}
-	}()
-	defer close(dw.cancel)
 
-	lastState := make(map[string]DeviceState)
-	devState := make([]serialDeviceState, 0, 8)
-	for {
-		select {
-		case <-dw.cancel:
-			close(dw.eventChan)
+		// The server is gone and with it all devices.
+		if !dw.update(nil) {
+			dw.err.Store(dw.ctx.Err())
 			return
-		default:
-		}
-		msg, err := readBytes(dw.conn)
-		if errors.Cause(err) == ErrConnectionReset {
-			// The server died, restart and reconnect.
-			err := start(dw.server)
-			if err != nil {
-				fmt.Println("[DeviceWatcher] error restarting server, giving up")
-				dw.err.Store(err)
-				return
-			}
-			continue
-		} else if err != nil {
-			// Unknown error, don't retry.
+		}
+		dw.conn, err = dw.reconnect()
+		if err != nil {
 			dw.err.Store(err)
-			close(dw.eventChan)
 			return
 		}
-		deviceStates := parseDeviceStates(bytes.NewReader(msg), devState)
-		calculateStateDiffs(deviceStates, lastState, dw.eventChan)
 	}
 }
 
-type serialDeviceState struct {
-	serial string
-	state  DeviceState
-}
+// errConnectionLost is returned by trackDevices if the connection failed.
+var errConnectionLost = errors.New("connection lost")
 
-// for even fewer allocations take sdss as pointer to slice so that enlargments
-// propagate
-func parseDeviceStates(r io.Reader, sdss []serialDeviceState) []serialDeviceState {
-	sdss = sdss[0:0:cap(sdss)]
-	scan := bufio.NewScanner(r)
+// trackDevices publishes events for the device lists received on dw.conn.
+// It returns errConnectionLost on connection errors and any other error
+// if the server sends garbage or the watcher is closed.
+func trackDevices(dw *DeviceWatcher, parse func(string) (DeviceInfo, error)) error {
+	for {
+		msg, err := readMessage(dw.conn)
+		if dw.ctx.Err() != nil {
+			return dw.ctx.Err()
+		} else if err != nil {
+			if _, ok := errors.Cause(err).(*strconv.NumError); ok {
+				return err
+			}
+			return errConnectionLost
+		}
+		devices, err := parseDeviceList(bytes.NewReader(msg), parse)
+		if err != nil {
+			return err
+		}
+		if !dw.update(devices) {
+			return dw.ctx.Err()
+		}
+	}
+}
 
-	for scan.Scan() {
-		line := scan.Text()
+// deviceKey identifies a device known to a watcher. Serials are not unique,
+// e.g. for a device connected by USB and TCP, so in long mode the transport
+// id tells them apart.
+type deviceKey struct {
+	serial      string
+	transportID int64
+}
 
-		fields := strings.Split(line, "\t")
-		if len(fields) != 2 {
-			continue
-		}
-		serial, stateString := fields[0], fields[1]
-		state := parseDeviceState(stateString)
-		sdss = append(sdss, serialDeviceState{serial, state})
+func newDeviceKey(di DeviceInfo, long bool) deviceKey {
+	if !long {
+		return deviceKey{serial: di.Serial}
 	}
-	return sdss
+	return deviceKey{di.Serial, di.TransportID}
 }
 
-func calculateStateDiffs(
-	lastState []serialDeviceState,
-	deviceStates map[string]DeviceState,
-	ch chan<- DeviceStateChangedEvent) {
+// diffDevices updates known to the current device list and returns an event
+// for every device whose state changed, or in long mode whose info changed.
+// Devices missing from list are reported as disconnected.
+func diffDevices(known map[deviceKey]DeviceInfo, list []DeviceInfo, long bool) []DeviceStateChangedEvent {
+	var (
+		events  []DeviceStateChangedEvent
+		keys    []deviceKey
+		current = make(map[deviceKey]DeviceInfo, len(list))
+	)
+	for _, di := range list {
+		key := newDeviceKey(di, long)
+		if _, ok := current[key]; !ok {
+			keys = append(keys, key)
+		}
+		// Without transport ids the last entry of a serial wins.
+		current[key] = di
+	}
 
-	var notContains = func(s string) bool {
-		for _, t := range lastState {
-			if t.serial == s {
-				return false
-			}
+	// Known devices missing from list by serial. A device with the same
+	// serial and a new transport id takes the place of one of them, e.g.
+	// after it moved to another USB port.
+	gone := make(map[string][]deviceKey)
+	for key := range known {
+		if _, ok := current[key]; !ok {
+			gone[key.serial] = append(gone[key.serial], key)
 		}
-		return true
+	}
+	for _, kk := range gone {
+		sort.Slice(kk, func(i, j int) bool { return kk[i].transportID < kk[j].transportID })
 	}
 
-	for _, sta := range lastState {
-		if old := deviceStates[sta.serial]; sta.state != old {
-			ch <- DeviceStateChangedEvent{
-				Serial:   sta.serial,
-				OldState: old,
-				NewState: sta.state,
+	for _, key := range keys {
+		newInfo := current[key]
+		old, ok := known[key]
+		if !ok {
+			old = DeviceInfo{Serial: key.serial, State: StateDisconnected}
+			if kk := gone[key.serial]; len(kk) > 0 {
+				old = known[kk[0]]
+				delete(known, kk[0])
+				gone[key.serial] = kk[1:]
 			}
-			deviceStates[sta.serial] = sta.state
 		}
+		known[key] = newInfo
+		if old.State == newInfo.State && (!long || old.Equal(newInfo)) {
+			continue
+		}
+		events = append(events, newDeviceEvent(old, newInfo, long))
 	}
 
-	for s := range deviceStates {
-		if notContains(s) {
-			ch <- DeviceStateChangedEvent{
-				Serial:   s,
-				OldState: deviceStates[s],
-				NewState: StateDisconnected,
-			}
-			delete(deviceStates, s)
+	for _, kk := range gone {
+		for _, key := range kk {
+			old := known[key]
+			delete(known, key)
+			gone := DeviceInfo{Serial: key.serial, State: StateDisconnected}
+			events = append(events, newDeviceEvent(old, gone, long))
 		}
 	}
+	return events
+}
+
+func newDeviceEvent(old, cur DeviceInfo, long bool) DeviceStateChangedEvent {
+	ev := DeviceStateChangedEvent{
+		Serial:   cur.Serial,
+		OldState: old.State,
+		NewState: cur.State,
+	}
+	if long {
+		ev.Old, ev.New = old, cur
+	}
+	return ev
 }
@@ -0,0 +1,97 @@
+package adb
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Dial connects to a socket on the device, see DialContext.
+func (d *Device) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to a socket on the device through the adb server
+// without creating a forward. It matches net.Dialer.DialContext, so it can
+// be used to talk to services on the device with e.g. http.Transport.
+//
+// For the networks "tcp", "tcp4" and "tcp6" address is "port", ":port" or
+// "localhost:port", adbd only connects to its loopback interface. For "unix"
+// address is a path, or a name in the abstract namespace if prefixed with
+// "@". Every ForwardSpec protocol is accepted as well, e.g. "localabstract",
+// with address being the rest of the spec.
+//
+// Like with net.Dialer, ctx only bounds connecting. Once connected,
+// cancelling ctx does not affect the connection.
+func (d *Device) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	spec, err := dialSpec(network, address)
+	if err != nil {
+		return nil, errors.WithMessage(err, "DialContext")
+	}
+	conn, err := d.OpenService(ctx, string(spec))
+	if err != nil {
+		return nil, errors.WithMessage(err, "DialContext")
+	}
+	// Detach the connection from ctx.
+	if cc, ok := conn.(*ctxConn); ok {
+		cc.stop()
+		conn = cc.Conn
+	}
+	if err := ctx.Err(); err != nil {
+		conn.Close()
+		return nil, errors.WithMessage(err, "DialContext")
+	}
+	conn.SetDeadline(time.Time{})
+	return &deviceConn{conn, deviceAddr{network, address}}, nil
+}
+
+// dialSpec returns the device service to connect to network address.
+func dialSpec(network, address string) (ForwardSpec, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		host, port := "", address
+		if strings.Contains(address, ":") {
+			var err error
+			host, port, err = net.SplitHostPort(address)
+			if err != nil {
+				return "", err
+			}
+		}
+		if !isLocalHost(host) {
+			return "", errors.Errorf("adbd only connects to localhost, not %s", host)
+		}
+		p, err := net.LookupPort("tcp", port)
+		if err != nil {
+			return "", err
+		}
+		return TCPSpec(p), nil
+	case "unix":
+		if strings.HasPrefix(address, "@") {
+			return LocalAbstractSpec(address[1:]), nil
+		}
+		return LocalFilesystemSpec(address), nil
+	}
+	return ParseForwardSpec(network + ":" + address)
+}
+
+// deviceAddr is the address a device connection was dialed with.
+type deviceAddr struct {
+	network, address string
+}
+
+func (a deviceAddr) Network() string { return a.network }
+func (a deviceAddr) String() string  { return a.address }
+
+// deviceConn reports the dialed address as its remote address instead of
+// the address of the adb server.
+type deviceConn struct {
+	net.Conn
+	raddr deviceAddr
+}
+
+func (c *deviceConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
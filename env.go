@@ -0,0 +1,115 @@
+package adb
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Environment variables understood by the official adb client.
+const (
+	// EnvServerSocket holds a socket spec of the server, e.g.
+	// "tcp:localhost:5037" or "localfilesystem:/run/adb.sock".
+	// It takes precedence over EnvServerAddress and EnvServerPort.
+	EnvServerSocket = "ADB_SERVER_SOCKET"
+	// EnvServerAddress holds the host name of the server.
+	EnvServerAddress = "ANDROID_ADB_SERVER_ADDRESS"
+	// EnvServerPort holds the TCP port of the server.
+	EnvServerPort = "ANDROID_ADB_SERVER_PORT"
+	// EnvSerial holds the serial number of the device to use if none is
+	// given explicitly.
+	EnvSerial = "ANDROID_SERIAL"
+)
+
+// ServerOptionsFromEnv returns ServerOptions locating the server the same
+// way the official adb client does, by looking at EnvServerSocket,
+// EnvServerAddress and EnvServerPort. Autostart is disabled for servers
+// not running on this host.
+func ServerOptionsFromEnv() (ServerOptions, error) {
+	return serverOptionsFromEnv(os.Getenv)
+}
+
+// DefaultSerial returns the serial number of the device selected by
+// EnvSerial. It is empty if the variable is unset.
+func DefaultSerial() string {
+	return os.Getenv(EnvSerial)
+}
+
+func serverOptionsFromEnv(getenv func(string) string) (ServerOptions, error) {
+	if spec := getenv(EnvServerSocket); spec != "" {
+		opts, err := parseServerSocket(spec)
+		return opts, errors.WithMessage(err, EnvServerSocket)
+	}
+
+	host := getenv(EnvServerAddress)
+	if host == "" {
+		host = "localhost"
+	}
+	port := DefaultPort
+	if s := getenv(EnvServerPort); s != "" {
+		p, err := strconv.Atoi(s)
+		if err != nil || p <= 0 || p > 65535 {
+			return ServerOptions{}, errors.Errorf(
+				"%s must be a positive number less than 65536, got %q", EnvServerPort, s)
+		}
+		port = p
+	}
+	return ServerOptions{
+		Path:        DefaultExecutableName,
+		Network:     "tcp",
+		Address:     net.JoinHostPort(host, strconv.Itoa(port)),
+		NoAutostart: !isLocalHost(host),
+	}, nil
+}
+
+// parseServerSocket parses a socket spec as accepted by ADB_SERVER_SOCKET:
+//
+//	tcp:<port>
+//	tcp:<host>:<port>
+//	localfilesystem:<path>
+//	localabstract:<name>
+func parseServerSocket(spec string) (ServerOptions, error) {
+	opts := ServerOptions{Path: DefaultExecutableName}
+	i := strings.IndexByte(spec, ':')
+	if i < 0 {
+		return ServerOptions{}, errors.Errorf("malformed socket spec: %s", spec)
+	}
+	protocol, rest := spec[:i], spec[i+1:]
+	switch protocol {
+	case FProtocolTCP:
+		host, port := "localhost", rest
+		if j := strings.LastIndexByte(rest, ':'); j >= 0 {
+			host, port = strings.Trim(rest[:j], "[]"), rest[j+1:]
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+			return ServerOptions{}, errors.Errorf("malformed port: %s", port)
+		}
+		opts.Network = "tcp"
+		opts.Address = net.JoinHostPort(host, port)
+		opts.NoAutostart = !isLocalHost(host)
+	case FProtocolFilesystem:
+		opts.Network = "unix"
+		opts.Address = rest
+	case FProtocolAbstract:
+		opts.Network = "unix"
+		opts.Address = "@" + rest
+	default:
+		return ServerOptions{}, errors.Errorf("unsupported socket spec: %s", spec)
+	}
+	if opts.Address == "" || opts.Address == "@" {
+		return ServerOptions{}, errors.Errorf("malformed socket spec: %s", spec)
+	}
+	return opts, nil
+}
+
+// isLocalHost reports whether host refers to this machine.
+func isLocalHost(host string) bool {
+	if host == "" || host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
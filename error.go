@@ -28,12 +28,30 @@ func (us *UnexpectedStatusError) Error() string {
 	return fmt.Sprintf("want one of %v, got %s", us.want, us.got)
 }
 
-// Rename CmdError?
+// ShellExitError is returned by Cmd when the command exits with a non-zero
+// exit code.
 type ShellExitError struct {
 	Command  string
 	ExitCode int
+	// Stderr holds the error output of the command if it was collected.
+	// Devices without shell protocol v2 mix it into the regular output.
+	Stderr []byte
 }
 
 func (s ShellExitError) Error() string {
 	return fmt.Sprintf("shell %q exit code %d", s.Command, s.ExitCode)
 }
+
+// ConnectError is returned when the server reports a failure while
+// connecting, disconnecting or pairing a network device.
+type ConnectError struct {
+	// Op is one of "connect", "disconnect" or "pair".
+	Op      string
+	Address string
+	// Msg is the message reported by the server.
+	Msg string
+}
+
+func (c *ConnectError) Error() string {
+	return fmt.Sprintf("%s %s: %s", c.Op, c.Address, c.Msg)
+}
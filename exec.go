@@ -0,0 +1,89 @@
+package adb
+
+import (
+	"context"
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// ExecOut runs cmd with args on the device like adb exec-out and returns
+// its output. Unlike Command the exec service allocates no PTY, so binary
+// output, e.g. of "screencap -p", is not mangled. Like with Command, cmd
+// and args are quoted for the device shell. The error output of the command
+// is mixed into the output and the exit code is lost.
+// The returned reader is closed when ctx is done.
+func (d *Device) ExecOut(ctx context.Context, cmd string, args ...string) (io.ReadCloser, error) {
+	return d.Exec(ctx, nil, cmd, args...)
+}
+
+// Exec is like ExecOut but sends stdin to the command if it is not nil.
+// Once stdin is exhausted the connection is closed for writing, which makes
+// the server close the stream like adb exec-in does. Use it for commands
+// like "dd of=file" that only consume their input, or ExecScript for
+// redirections.
+func (d *Device) Exec(ctx context.Context, stdin io.Reader, cmd string, args ...string) (io.ReadCloser, error) {
+	line, err := d.Command(cmd, args...).commandLine(false)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Exec")
+	}
+	rc, err := d.exec(ctx, stdin, line)
+	return rc, errors.WithMessage(err, "Exec")
+}
+
+// ExecScript is like Exec but runs a shell script which is passed to the
+// device shell verbatim, like Script does. It allows uploads like
+//
+//	d.ExecScript(ctx, r, "cat > /data/local/tmp/file")
+//
+// Never build the script from untrusted input, use Exec instead.
+func (d *Device) ExecScript(ctx context.Context, stdin io.Reader, script string) (io.ReadCloser, error) {
+	rc, err := d.exec(ctx, stdin, script)
+	return rc, errors.WithMessage(err, "ExecScript")
+}
+
+// exec runs line with the exec service and sends stdin to it. The
+// connection is closed if stdin cannot be sent in full.
+func (d *Device) exec(ctx context.Context, stdin io.Reader, line string) (io.ReadCloser, error) {
+	conn, err := d.OpenService(ctx, "exec:"+line)
+	if err != nil {
+		return nil, err
+	}
+	if stdin == nil {
+		return conn, nil
+	}
+	// Without the half close the command never sees the end of its input.
+	cw, err := asCloseWriter(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go func() {
+		_, err := io.Copy(conn, stdin)
+		if err == nil {
+			err = cw.CloseWrite()
+		}
+		if err != nil {
+			conn.Close()
+		}
+	}()
+	return conn, nil
+}
+
+// closeWriter is a connection that can be shut down for writing only.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// asCloseWriter returns conn as closeWriter or an error if it cannot be
+// shut down for writing.
+func asCloseWriter(conn net.Conn) (closeWriter, error) {
+	if cc, ok := conn.(*ctxConn); ok {
+		conn = cc.Conn
+	}
+	if cw, ok := conn.(closeWriter); ok {
+		return cw, nil
+	}
+	return nil, errors.New("connection does not support CloseWrite")
+}
@@ -26,13 +26,21 @@ func ListProcesses(d *adb.Device) ([]Process, error) {
 	//     USER  PID  PPID  VSIZE  RSS  WCHAN     PC         NAME
 	//     root    1     0    684  540  ffffffff  00000000 S /init
 	//     root    2     0      0    0  ffffffff  00000000 S kthreadd
-	out, err := d.Command("ps").Output()
+	// Since Android 8 ps only lists the processes of the shell unless
+	// given -A, which older versions take as a process name instead.
+	out, err := d.Command("ps", "-A").Output()
 	if err != nil {
 		return nil, err
 	}
+	if bytes.Count(out, []byte("\n")) <= 1 {
+		out, err = d.Command("ps").Output()
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	var (
-		fieldNames = make([]string, 0, 4)
+		fieldNames []string
 		pp         = make([]Process, 0, 4)
 		bufrd      = bufio.NewReader(bytes.NewReader(out))
 	)
@@ -50,7 +58,8 @@ func ListProcesses(d *adb.Device) ([]Process, error) {
 			fieldNames = fields
 			continue
 		}
-		if len(fields) != len(fieldNames)+1 {
+		// Older versions print the state without a header.
+		if len(fields) != len(fieldNames) && len(fields) != len(fieldNames)+1 {
 			return nil, errors.New("unexpected format")
 		}
 
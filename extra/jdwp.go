@@ -0,0 +1,100 @@
+package extra
+
+import (
+	"context"
+	"time"
+
+	"github.com/d1ced/adb"
+)
+
+// JDWPProcessEvent is an adb.JDWPEvent joined with the process it is about.
+// Process.Name and Process.User are empty if the process was not listed by
+// ps, e.g. because it ended already.
+type JDWPProcessEvent struct {
+	adb.JDWPEvent
+	Process Process
+}
+
+// JDWPTracker is an adb.JDWPTracker reporting process names.
+type JDWPTracker struct {
+	t      *adb.JDWPTracker
+	ctx    context.Context
+	cancel context.CancelFunc
+	c      chan JDWPProcessEvent
+}
+
+// TrackJDWP tracks the debuggable processes of d like d.TrackJDWP and looks
+// up the started processes with ListProcesses.
+func TrackJDWP(ctx context.Context, d *adb.Device) (*JDWPTracker, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	t, err := d.TrackJDWP(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	jt := &JDWPTracker{t: t, ctx: ctx, cancel: cancel, c: make(chan JDWPProcessEvent)}
+	go jt.run(d)
+	return jt, nil
+}
+
+// C returns the channel events are delivered on. It is closed when the
+// tracker stops.
+func (jt *JDWPTracker) C() <-chan JDWPProcessEvent {
+	return jt.c
+}
+
+// Err returns the error that stopped the tracker once C is closed.
+func (jt *JDWPTracker) Err() error {
+	return jt.t.Err()
+}
+
+// Close stops the tracker.
+func (jt *JDWPTracker) Close() error {
+	jt.cancel()
+	return nil
+}
+
+func (jt *JDWPTracker) run(d *adb.Device) {
+	defer close(jt.c)
+	var (
+		// Listing the processes is slow, so a listing serves all processes
+		// started at about the same time, e.g. those running when tracking
+		// began. It is only reused for a short time as pids get recycled.
+		listing  map[int]Process
+		listedAt time.Time
+		// tracked are the processes added and not removed yet.
+		tracked = make(map[int]Process)
+	)
+	for ev := range jt.t.C() {
+		p, ok := tracked[ev.Pid]
+		if ev.Added {
+			if _, listed := listing[ev.Pid]; !listed || time.Since(listedAt) > time.Second {
+				listing, listedAt = listProcesses(d), time.Now()
+			}
+			p, ok = listing[ev.Pid]
+		}
+		if !ok {
+			p = Process{Pid: ev.Pid}
+		}
+		if ev.Added {
+			tracked[ev.Pid] = p
+		} else {
+			delete(tracked, ev.Pid)
+		}
+		select {
+		case jt.c <- JDWPProcessEvent{ev, p}:
+		case <-jt.ctx.Done():
+			return
+		}
+	}
+}
+
+// listProcesses returns the processes by pid, or none if listing fails.
+func listProcesses(d *adb.Device) map[int]Process {
+	pp, _ := ListProcesses(d)
+	m := make(map[int]Process, len(pp))
+	for _, p := range pp {
+		m[p.Pid] = p
+	}
+	return m
+}
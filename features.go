@@ -0,0 +1,136 @@
+package adb
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Feature is a protocol feature advertised by the server or a device.
+type Feature string
+
+// Features known to this package. See adb/transport.cpp for the full list.
+const (
+	FeatureShell2                    Feature = "shell_v2"
+	FeatureCmd                       Feature = "cmd"
+	FeatureStat2                     Feature = "stat_v2"
+	FeatureLs2                       Feature = "ls_v2"
+	FeatureLibusb                    Feature = "libusb"
+	FeaturePushSync                  Feature = "push_sync"
+	FeatureApex                      Feature = "apex"
+	FeatureFixedPushMkdir            Feature = "fixed_push_mkdir"
+	FeatureAbb                       Feature = "abb"
+	FeatureFixedPushSymlinkTimestamp Feature = "fixed_push_symlink_timestamp"
+	FeatureAbbExec                   Feature = "abb_exec"
+	FeatureRemountShell              Feature = "remount_shell"
+	FeatureTrackApp                  Feature = "track_app"
+	FeatureSendRecv2                 Feature = "sendrecv_v2"
+	FeatureSendRecv2Brotli           Feature = "sendrecv_v2_brotli"
+	FeatureSendRecv2LZ4              Feature = "sendrecv_v2_lz4"
+	FeatureSendRecv2Zstd             Feature = "sendrecv_v2_zstd"
+	FeatureSendRecv2DryRunSend       Feature = "sendrecv_v2_dry_run_send"
+	FeatureDelayedAck                Feature = "delayed_ack"
+	FeatureOpenscreenMdns            Feature = "openscreen_mdns"
+	FeatureDeviceTrackerProtoFormat  Feature = "devicetracker_proto_format"
+	FeatureDevRaw                    Feature = "devraw"
+	FeatureAppInfo                   Feature = "app_info"
+	FeatureServerStatus              Feature = "server_status"
+)
+
+// FeatureSet is a set of features. The zero value is an empty set.
+type FeatureSet map[Feature]struct{}
+
+// Has reports whether f is in the set.
+func (fs FeatureSet) Has(f Feature) bool {
+	_, ok := fs[f]
+	return ok
+}
+
+// String returns the features sorted and separated by commas, the same
+// format used on the wire.
+func (fs FeatureSet) String() string {
+	ff := make([]string, 0, len(fs))
+	for f := range fs {
+		ff = append(ff, string(f))
+	}
+	sort.Strings(ff)
+	return strings.Join(ff, ",")
+}
+
+func parseFeatureSet(s string) FeatureSet {
+	fs := make(FeatureSet)
+	for _, f := range strings.Split(strings.TrimSpace(s), ",") {
+		if f != "" {
+			fs[Feature(f)] = struct{}{}
+		}
+	}
+	return fs
+}
+
+// HostFeatures returns the features supported by the server. The result is
+// cached, use the returned set read-only.
+func (s *Server) HostFeatures() (FeatureSet, error) {
+	return s.HostFeaturesContext(context.Background())
+}
+
+// HostFeaturesContext is like HostFeatures but aborts when ctx is done.
+func (s *Server) HostFeaturesContext(ctx context.Context) (FeatureSet, error) {
+	s.mu.Lock()
+	fs := s.hostFeatures
+	s.mu.Unlock()
+	if fs != nil {
+		return fs, nil
+	}
+
+	b, err := s.requestResponseBytes(ctx, "host-features")
+	if err != nil {
+		return nil, errors.WithMessage(err, "HostFeatures")
+	}
+	fs = parseFeatureSet(string(b))
+
+	s.mu.Lock()
+	s.hostFeatures = fs
+	s.mu.Unlock()
+	return fs, nil
+}
+
+// Features returns the features supported by the device. The result is
+// cached, use the returned set read-only.
+func (d *Device) Features() (FeatureSet, error) {
+	return d.FeaturesContext(context.Background())
+}
+
+// FeaturesContext is like Features but aborts when ctx is done.
+func (d *Device) FeaturesContext(ctx context.Context) (FeatureSet, error) {
+	d.mu.Lock()
+	fs := d.features
+	d.mu.Unlock()
+	if fs != nil {
+		return fs, nil
+	}
+
+	b, err := d.requestResponseString(ctx, "features")
+	if err != nil {
+		return nil, errors.WithMessage(err, "Features")
+	}
+	fs = parseFeatureSet(string(b))
+
+	d.mu.Lock()
+	d.features = fs
+	d.mu.Unlock()
+	return fs, nil
+}
+
+// hasFeature reports whether f is supported by both the device and the
+// server. Failing to query the features, e.g. on very old servers, is
+// treated as f being unsupported so callers fall back to older protocols.
+func (d *Device) hasFeature(ctx context.Context, f Feature) bool {
+	fs, err := d.FeaturesContext(ctx)
+	if err != nil || !fs.Has(f) {
+		return false
+	}
+	hfs, err := d.server.HostFeaturesContext(ctx)
+	return err == nil && hfs.Has(f)
+}
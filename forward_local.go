@@ -0,0 +1,202 @@
+package adb
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// LocalForward forwards the connections accepted by a local listener to a
+// socket on the device. Unlike Device.Forward no listener is created in the
+// adb server, so nothing is left behind when the process exits.
+// Use Device.Listen or Device.ForwardLocal to create one.
+type LocalForward struct {
+	// accessed atomically, keep first for alignment
+	accepted uint64
+	failed   uint64
+	sent     uint64
+	received uint64
+	active   int64
+
+	d      *Device
+	l      net.Listener
+	remote ForwardSpec
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	done   chan struct{}
+	err    error
+}
+
+// LocalForwardStats are the metrics of a LocalForward.
+type LocalForwardStats struct {
+	// Accepted counts the local connections.
+	Accepted uint64
+	// Failed counts the connections for which remote could not be opened.
+	Failed uint64
+	// Active is the number of connections currently forwarded.
+	Active int64
+	// BytesSent and BytesReceived count the bytes to and from the device.
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// Listen listens on the local network address, e.g. "tcp" "127.0.0.1:0",
+// and forwards the connections to remote, see ForwardLocal.
+func (d *Device) Listen(ctx context.Context, network, address string, remote ForwardSpec) (*LocalForward, error) {
+	if _, err := ParseForwardSpec(string(remote)); err != nil {
+		return nil, errors.WithMessage(err, "Listen")
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Listen")
+	}
+	return d.ForwardLocal(ctx, l, remote)
+}
+
+// ForwardLocal accepts connections from l and connects each to remote on
+// the device through the adb server until ctx is done or the forward is
+// closed. l is closed when ForwardLocal returns with an error or the
+// forward ends.
+func (d *Device) ForwardLocal(ctx context.Context, l net.Listener, remote ForwardSpec) (*LocalForward, error) {
+	if _, err := ParseForwardSpec(string(remote)); err != nil {
+		l.Close()
+		return nil, errors.WithMessage(err, "ForwardLocal")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	f := &LocalForward{
+		d:      d,
+		l:      l,
+		remote: remote,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go f.serve()
+	return f, nil
+}
+
+// Addr returns the address of the local listener.
+func (f *LocalForward) Addr() net.Addr {
+	return f.l.Addr()
+}
+
+// Remote returns the spec connections are forwarded to.
+func (f *LocalForward) Remote() ForwardSpec {
+	return f.remote
+}
+
+// Stats returns the current metrics of the forward.
+func (f *LocalForward) Stats() LocalForwardStats {
+	return LocalForwardStats{
+		Accepted:      atomic.LoadUint64(&f.accepted),
+		Failed:        atomic.LoadUint64(&f.failed),
+		Active:        atomic.LoadInt64(&f.active),
+		BytesSent:     atomic.LoadUint64(&f.sent),
+		BytesReceived: atomic.LoadUint64(&f.received),
+	}
+}
+
+// Done is closed once the forward ended and all connections are closed.
+func (f *LocalForward) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the error that ended the forward, if the listener failed.
+// It returns nil while the forward is running or if it was stopped.
+func (f *LocalForward) Err() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+// Close stops the forward, closes all its connections and waits for them.
+func (f *LocalForward) Close() error {
+	f.cancel()
+	<-f.done
+	return f.err
+}
+
+func (f *LocalForward) serve() {
+	defer close(f.done)
+	stop := watchConn(f.ctx, f.l)
+	for {
+		conn, err := f.l.Accept()
+		if err != nil {
+			if f.ctx.Err() == nil {
+				f.err = errors.WithMessage(err, "ForwardLocal")
+			}
+			break
+		}
+		atomic.AddUint64(&f.accepted, 1)
+		f.wg.Add(1)
+		go f.handle(conn)
+	}
+	stop()
+	f.cancel()
+	f.l.Close()
+	f.wg.Wait()
+}
+
+func (f *LocalForward) handle(local net.Conn) {
+	defer f.wg.Done()
+	defer local.Close()
+	stop := watchConn(f.ctx, local)
+	defer stop()
+
+	remote, err := f.d.OpenService(f.ctx, string(f.remote))
+	if err != nil {
+		atomic.AddUint64(&f.failed, 1)
+		return
+	}
+	defer remote.Close()
+
+	atomic.AddInt64(&f.active, 1)
+	defer atomic.AddInt64(&f.active, -1)
+	splice(local, remote, &f.sent, &f.received)
+}
+
+// splice copies between a and b in both directions. When one direction
+// ends its destination is closed for writing, so the peer sees the end of
+// the data while the other direction continues. Both are closed once both
+// directions are done. The bytes copied are added to sent and received.
+func splice(a, b net.Conn, sent, received *uint64) {
+	var wg sync.WaitGroup
+	cp := func(dst, src net.Conn, n *uint64) {
+		defer wg.Done()
+		_, err := io.Copy(&countingWriter{dst, n}, src)
+		if err == nil {
+			if cw, err := asCloseWriter(dst); err == nil && cw.CloseWrite() == nil {
+				return
+			}
+		}
+		// The other direction would not end on its own.
+		a.Close()
+		b.Close()
+	}
+	wg.Add(2)
+	go cp(b, a, sent)
+	go cp(a, b, received)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+// countingWriter adds the number of bytes written to n atomically.
+type countingWriter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	atomic.AddUint64(cw.n, uint64(n))
+	return n, err
+}
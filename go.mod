@@ -11,6 +11,6 @@ require (
 	github.com/mattn/go-runewidth v0.0.4 // indirect
 	github.com/pkg/errors v0.8.1
 	github.com/stretchr/testify v1.3.0 // indirect
-	golang.org/x/sys v0.0.0-20190204203706-41f3e6584952 // indirect
+	golang.org/x/sys v0.0.0-20190204203706-41f3e6584952
 	gopkg.in/cheggaaa/pb.v1 v1.0.28 // indirect
 )
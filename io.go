@@ -1,10 +1,13 @@
 package adb
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -13,10 +16,17 @@ import (
 const (
 	statusOK   = "OKAY"
 	statusFail = "FAIL"
+
+	// defaultTimeout bounds short request/response exchanges with the
+	// server if the context has no deadline of its own.
+	defaultTimeout = 10 * time.Second
 )
 
 // use this only for short writes
 func sendMessage(w io.Writer, msg string) error {
+	if len(msg) > 0xffff {
+		return errors.Errorf("message exceeds maximum length: %d", len(msg))
+	}
 	n, err := w.Write([]byte(fmt.Sprintf("%04x%s", len(msg), msg)))
 	if err != nil {
 		return err
@@ -31,15 +41,15 @@ func sendSyncMessage(w io.Writer, status, msg string) error {
 	if len(msg) > syncMaxChunkSize {
 		return errors.New("maximum message length exceded")
 	}
-	buf := make([]byte, len(status)+4+len(msg))
-	buf = append(buf, status...)
-	binary.LittleEndian.PutUint32(buf, uint32(len(msg)))
+	buf := make([]byte, len(status)+4, len(status)+4+len(msg))
+	copy(buf, status)
+	binary.LittleEndian.PutUint32(buf[len(status):], uint32(len(msg)))
 	buf = append(buf, msg...)
 	n, err := w.Write(buf)
 	if err != nil {
 		return err
 	}
-	if n != len(msg)+4 {
+	if n != len(buf) {
 		return io.ErrShortWrite
 	}
 	return nil
@@ -141,34 +151,158 @@ func readBytes(r io.Reader, acceptStatus ...string) ([]byte, error) {
 	return buf, nil
 }
 
-func requestResponseBytes(address, msg string) ([]byte, error) {
-	conn, err := dial(address)
+// shortDeadline returns the deadline of ctx or, if it has none, the
+// servers request timeout from now.
+func (s *Server) shortDeadline(ctx context.Context) time.Time {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline
+	}
+	if s.timeout > 0 {
+		return time.Now().Add(s.timeout)
+	}
+	return time.Now().Add(defaultTimeout)
+}
+
+// ctxErr returns the error of ctx instead of err if ctx is done. Errors on
+// a connection that was closed because of a cancellation carry no useful
+// information for the caller.
+func ctxErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// watchConn closes conn as soon as ctx is done. The returned function
+// stops watching and must be called once conn is not used anymore.
+// It is safe to call it multiple times.
+func watchConn(ctx context.Context, conn io.Closer) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	var (
+		once    sync.Once
+		done    = make(chan struct{})
+		stopped = make(chan struct{})
+	)
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
+
+// ctxConn is a net.Conn bound to the lifetime of a context. Once the context
+// is done the connection is closed and all operations report ctx.Err().
+type ctxConn struct {
+	net.Conn
+	ctx  context.Context
+	stop func()
+}
+
+func (c *ctxConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	return n, ctxErr(c.ctx, err)
+}
+
+func (c *ctxConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	return n, ctxErr(c.ctx, err)
+}
+
+func (c *ctxConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
+
+// dialContext connects to the server. The returned connection is closed
+// when ctx is done.
+func (s *Server) dialContext(ctx context.Context) (net.Conn, error) {
+	var (
+		dialFn  = s.dial
+		network = s.network
+		dialCtx = ctx
+	)
+	if dialFn == nil {
+		dialFn = dial
+	}
+	if network == "" {
+		network = "tcp"
+	}
+	if s.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, s.dialTimeout)
+		defer cancel()
+	}
+	conn, err := dialFn(dialCtx, network, s.address)
+	if err != nil {
+		return nil, ctxErr(ctx, err)
+	}
+	if ctx.Done() == nil {
+		return conn, nil
+	}
+	return &ctxConn{conn, ctx, watchConn(ctx, conn)}, nil
+}
+
+// readMessage reads a message prefixed by its length as 4 hex digits, as
+// sent repeatedly by long-lived services like track-devices after the
+// initial status.
+func readMessage(r io.Reader) ([]byte, error) {
+	head := make([]byte, 4)
+	_, err := io.ReadFull(r, head)
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.ParseUint(string(head), 16, 16)
+	if err != nil {
+		return nil, errors.Wrapf(err, "length could not be parsed %s", head)
+	}
+	buf := make([]byte, length)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func requestResponseBytes(ctx context.Context, s *Server, msg string) ([]byte, error) {
+	conn, err := s.dialContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
-	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.SetDeadline(s.shortDeadline(ctx))
 
 	err = sendMessage(conn, msg)
 	if err != nil {
 		return nil, err
 	}
 
-	return readBytes(conn)
+	b, err := readBytes(conn)
+	return b, ctxErr(ctx, err)
 }
 
-func send(address, msg string) error {
-	conn, err := dial(address)
+func send(ctx context.Context, s *Server, msg string) error {
+	conn, err := s.dialContext(ctx)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
-	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.SetDeadline(s.shortDeadline(ctx))
 
 	err = sendMessage(conn, msg)
 	if err != nil {
 		return err
 	}
 
-	return wantStatus(conn)
+	return ctxErr(ctx, wantStatus(conn))
 }
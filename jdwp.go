@@ -0,0 +1,123 @@
+package adb
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// JDWPPids returns the pids of the processes on the device that can be
+// debugged via JDWP, like adb jdwp.
+func (d *Device) JDWPPids() ([]int, error) {
+	return d.JDWPPidsContext(context.Background())
+}
+
+// JDWPPidsContext is like JDWPPids but aborts when ctx is done.
+func (d *Device) JDWPPidsContext(ctx context.Context) ([]int, error) {
+	b, err := d.trackOnce(ctx, "track-jdwp")
+	if err != nil {
+		return nil, errors.WithMessage(err, "JDWPPids")
+	}
+	pids, err := parseJDWPPids(b)
+	return pids, errors.WithMessage(err, "JDWPPids")
+}
+
+// JDWPEvent reports a debuggable process that started or ended.
+type JDWPEvent struct {
+	Pid int
+	// Added is set if the process started, or was running when tracking
+	// began, and unset if it ended.
+	Added bool
+}
+
+// JDWPTracker reports debuggable processes on a device as they come and go.
+// Use Device.TrackJDWP to create one.
+type JDWPTracker struct {
+	tracker
+	c chan JDWPEvent
+}
+
+// TrackJDWP starts tracking the debuggable processes of the device. The
+// first events add the processes running at the time. The tracker stops
+// when ctx is done, it is closed or the connection fails.
+func (d *Device) TrackJDWP(ctx context.Context) (*JDWPTracker, error) {
+	tr, err := d.openTracker(ctx, "track-jdwp")
+	if err != nil {
+		return nil, errors.WithMessage(err, "TrackJDWP")
+	}
+	t := &JDWPTracker{tracker: tr, c: make(chan JDWPEvent)}
+	go t.run()
+	return t, nil
+}
+
+// C returns the channel events are delivered on. It is closed when the
+// tracker stops.
+func (t *JDWPTracker) C() <-chan JDWPEvent {
+	return t.c
+}
+
+func (t *JDWPTracker) run() {
+	defer close(t.c)
+	known := make(map[int]bool)
+	t.tracker.run("TrackJDWP", func(b []byte) error {
+		pids, err := parseJDWPPids(b)
+		if err != nil {
+			return err
+		}
+		for _, ev := range diffJDWPPids(known, pids) {
+			select {
+			case t.c <- ev:
+			case <-t.ctx.Done():
+				return t.ctx.Err()
+			}
+		}
+		return nil
+	})
+}
+
+// parseJDWPPids parses one pid per line.
+func parseJDWPPids(b []byte) ([]int, error) {
+	var pids []int
+	for _, f := range strings.Fields(string(b)) {
+		pid, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, errors.Errorf("malformed pid %q", f)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// diffJDWPPids updates known to pids and returns the events for the
+// processes removed and added, each sorted by pid.
+func diffJDWPPids(known map[int]bool, pids []int) []JDWPEvent {
+	cur := make(map[int]bool, len(pids))
+	var added, removed []int
+	for _, pid := range pids {
+		cur[pid] = true
+		if !known[pid] {
+			added = append(added, pid)
+		}
+	}
+	for pid := range known {
+		if !cur[pid] {
+			removed = append(removed, pid)
+			delete(known, pid)
+		}
+	}
+	sort.Ints(added)
+	sort.Ints(removed)
+
+	events := make([]JDWPEvent, 0, len(added)+len(removed))
+	for _, pid := range removed {
+		events = append(events, JDWPEvent{Pid: pid})
+	}
+	for _, pid := range added {
+		known[pid] = true
+		events = append(events, JDWPEvent{Pid: pid, Added: true})
+	}
+	return events
+}
@@ -1,6 +1,7 @@
 package adb
 
 import (
+	"context"
 	"io"
 	"net"
 	"sync"
@@ -25,8 +26,8 @@ type mockConn struct {
 	t        *testing.T
 }
 
-func mockDial(t *testing.T, in, out string) func(a string) (net.Conn, error) {
-	return func(address string) (net.Conn, error) {
+func mockDial(t *testing.T, in, out string) func(ctx context.Context, n, a string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
 		return &mockConn{
 			out:  []byte(out),
 			in:   []byte(in),
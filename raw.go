@@ -0,0 +1,56 @@
+package adb
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+// OpenService sends the host service request, e.g. "host:track-devices",
+// to the server and returns the raw stream after the server accepted it.
+// A FAIL reply is returned as error carrying the servers message.
+// Use Device.OpenService for device services. The returned connection is
+// closed when ctx is done.
+func (s *Server) OpenService(ctx context.Context, service string) (net.Conn, error) {
+	conn, err := s.dialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	err = sendMessage(conn, service)
+	if err == nil {
+		err = wantStatus(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, ctxErr(ctx, err)
+	}
+	return conn, nil
+}
+
+// SendMessage writes msg prefixed by its length as 4 hex digits, the
+// framing of all requests to the server.
+func SendMessage(w io.Writer, msg string) error {
+	return sendMessage(w, msg)
+}
+
+// ReadStatus reads a status and returns an error unless it is OKAY.
+// A FAIL status is returned as error carrying the message that follows.
+func ReadStatus(r io.Reader) error {
+	return wantStatus(r)
+}
+
+// ReadMessage reads a message prefixed by its length as 4 hex digits.
+// Long-lived services like track-devices or track-jdwp send one such
+// message per update.
+func ReadMessage(r io.Reader) ([]byte, error) {
+	return readMessage(r)
+}
+
+// ReadResponse reads a status followed by a length prefixed message, the
+// reply to most one-shot host services like host:version.
+func ReadResponse(r io.Reader) ([]byte, error) {
+	return readBytes(r)
+}
@@ -1,6 +1,48 @@
 // A simple tool for sending raw messages to an adb server.
 package adb_test
 
-func ExampleRaw() {
-	// TBD
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/d1ced/adb"
+)
+
+func Example_raw() {
+	client, _ := adb.NewDefault()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// One-shot host service: the server replies with a single message.
+	conn, err := client.OpenService(ctx, "host:host-features")
+	if err != nil {
+		panic(err)
+	}
+	features, err := adb.ReadMessage(conn)
+	conn.Close()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Host features:", string(features))
+
+	// Long-lived device service: the device sends a message per update
+	// until ctx is done.
+	device := client.Device(adb.DefaultSerial())
+	if device == nil {
+		panic("device not found")
+	}
+	conn, err = device.OpenService(ctx, "track-jdwp")
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+	for {
+		pids, err := adb.ReadMessage(conn)
+		if err != nil {
+			break
+		}
+		fmt.Printf("Debuggable processes:\n%s", pids)
+	}
 }
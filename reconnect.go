@@ -0,0 +1,285 @@
+package adb
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Reconnect tells the server to drop and reestablish the connection to the
+// only connected device, like adb reconnect.
+func (s *Server) Reconnect() error {
+	return s.ReconnectContext(context.Background())
+}
+
+// ReconnectContext is like Reconnect but aborts when ctx is done.
+func (s *Server) ReconnectContext(ctx context.Context) error {
+	_, err := s.requestResponseBytes(ctx, "reconnect")
+	return errors.WithMessage(err, "Reconnect")
+}
+
+// ReconnectOffline tells the server to reconnect all devices that are not
+// online, like adb reconnect offline. It returns the serials of the devices
+// being reconnected.
+func (s *Server) ReconnectOffline() ([]string, error) {
+	return s.ReconnectOfflineContext(context.Background())
+}
+
+// ReconnectOfflineContext is like ReconnectOffline but aborts when ctx is
+// done.
+func (s *Server) ReconnectOfflineContext(ctx context.Context) ([]string, error) {
+	b, err := s.requestResponseBytes(ctx, "reconnect-offline")
+	if err != nil {
+		return nil, errors.WithMessage(err, "ReconnectOffline")
+	}
+	// One "reconnecting <serial>" line per device.
+	var serials []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if serial := strings.TrimPrefix(line, "reconnecting "); serial != line {
+			serials = append(serials, strings.TrimSpace(serial))
+		}
+	}
+	return serials, nil
+}
+
+// Reconnect tells the server to drop and reestablish the connection to d.
+func (d *Device) Reconnect() error {
+	return d.ReconnectContext(context.Background())
+}
+
+// ReconnectContext is like Reconnect but aborts when ctx is done.
+func (d *Device) ReconnectContext(ctx context.Context) error {
+	_, err := d.requestResponseString(ctx, "reconnect")
+	return errors.WithMessage(err, "Reconnect")
+}
+
+// ReconnectDevice tells adbd on the device to drop its connection to the
+// server, like adb reconnect device. The device must be online.
+func (d *Device) ReconnectDevice() error {
+	return d.ReconnectDeviceContext(context.Background())
+}
+
+// ReconnectDeviceContext is like ReconnectDevice but aborts when ctx is
+// done.
+func (d *Device) ReconnectDeviceContext(ctx context.Context) error {
+	conn, err := d.OpenService(ctx, "reconnect")
+	if err != nil {
+		return errors.WithMessage(err, "ReconnectDevice")
+	}
+	return conn.Close()
+}
+
+// RecoveryPolicy configures RecoverDevices.
+type RecoveryPolicy struct {
+	// After is how long a device may stay offline or unauthorized before it
+	// is reconnected. Defaults to 30 seconds.
+	After time.Duration
+	// Backoff is the delay before reconnecting a device again if it is still
+	// stuck. It doubles after every attempt up to MaxBackoff.
+	// Defaults to After and 5 minutes.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// MaxAttempts limits the reconnects per device. Zero means no limit.
+	MaxAttempts int
+	// ResetAfter is how long a device must stay online or gone before its
+	// attempts and backoff start over. A reconnect makes the device vanish
+	// and reappear, which must not reset them. Defaults to MaxBackoff.
+	ResetAfter time.Duration
+	// Report is called after every reconnect. It may be nil.
+	Report func(RecoveryAction)
+}
+
+// RecoveryAction describes a reconnect issued by RecoverDevices.
+type RecoveryAction struct {
+	Serial string
+	// State the device was stuck in.
+	State DeviceState
+	// Since is when the device entered State.
+	Since time.Time
+	// Attempt counts the reconnects of this device, starting at 1.
+	Attempt int
+	// Err is the result of the reconnect.
+	Err error
+}
+
+// RecoverDevices watches for devices that are stuck offline or
+// unauthorized for longer than p.After and reconnects them with
+// exponential backoff. It blocks until ctx is done or the device watcher
+// fails and returns the cause.
+func (s *Server) RecoverDevices(ctx context.Context, p RecoveryPolicy) error {
+	watcher, err := s.NewDeviceWatcherContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	r := newRecoverer(p)
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	for {
+		select {
+		case ev, ok := <-watcher.C():
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return watcher.Err()
+			}
+			r.observe(ev, time.Now())
+		case <-timer.C:
+			for _, action := range r.due(time.Now()) {
+				action.Err = s.deviceBySerial(action.Serial).ReconnectContext(ctx)
+				if p.Report != nil {
+					p.Report(action)
+				}
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if next, ok := r.next(); ok {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// deviceBySerial returns a Device without checking its existence.
+func (s *Server) deviceBySerial(serial string) *Device {
+	return &Device{server: s, serial: serial}
+}
+
+// recoverer tracks stuck devices for RecoverDevices.
+type recoverer struct {
+	policy RecoveryPolicy
+	stuck  map[string]*stuckDevice
+}
+
+// stuckDevice is a device that got stuck. It is kept while the device is
+// not stuck for less than ResetAfter.
+type stuckDevice struct {
+	state    DeviceState // StateInvalid once the device recovered
+	since    time.Time   // when the device got stuck in state
+	freed    time.Time   // when the device left state, zero while stuck
+	attempts int
+	backoff  time.Duration
+	due      time.Time // zero if no reconnect is scheduled
+}
+
+func newRecoverer(p RecoveryPolicy) *recoverer {
+	if p.After <= 0 {
+		p.After = 30 * time.Second
+	}
+	if p.Backoff <= 0 {
+		p.Backoff = p.After
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 5 * time.Minute
+	}
+	if p.ResetAfter <= 0 {
+		p.ResetAfter = p.MaxBackoff
+	}
+	return &recoverer{policy: p, stuck: make(map[string]*stuckDevice)}
+}
+
+func (r *recoverer) observe(ev DeviceStateChangedEvent, now time.Time) {
+	sd := r.stuck[ev.Serial]
+	if sd != nil && !sd.freed.IsZero() && now.Sub(sd.freed) >= r.policy.ResetAfter {
+		delete(r.stuck, ev.Serial)
+		sd = nil
+	}
+	switch ev.NewState {
+	case StateOffline, StateUnauthorized:
+		if sd == nil {
+			sd = &stuckDevice{backoff: r.policy.Backoff}
+			r.stuck[ev.Serial] = sd
+		}
+		// A device that comes back in the same state, e.g. after being
+		// kicked by a reconnect, is stuck since it first got there.
+		if sd.state != ev.NewState {
+			sd.state, sd.since = ev.NewState, now
+		}
+		sd.freed = time.Time{}
+		if r.exhausted(sd) {
+			return
+		}
+		// Wait at least After, and the backoff after the last reconnect.
+		due := now.Add(r.policy.After)
+		if sd.due.After(due) {
+			due = sd.due
+		}
+		sd.due = due
+	default:
+		if sd == nil {
+			break
+		}
+		if sd.freed.IsZero() {
+			sd.freed = now
+		}
+		if ev.NewState != StateDisconnected {
+			sd.state = StateInvalid
+		}
+	}
+}
+
+// exhausted reports whether sd must not be reconnected again.
+func (r *recoverer) exhausted(sd *stuckDevice) bool {
+	return r.policy.MaxAttempts > 0 && sd.attempts >= r.policy.MaxAttempts
+}
+
+// due returns the reconnects to issue at now and schedules the next ones.
+func (r *recoverer) due(now time.Time) []RecoveryAction {
+	var actions []RecoveryAction
+	for serial, sd := range r.stuck {
+		if !sd.freed.IsZero() {
+			if now.Sub(sd.freed) >= r.policy.ResetAfter {
+				delete(r.stuck, serial)
+			}
+			continue
+		}
+		if sd.due.IsZero() || sd.due.After(now) {
+			continue
+		}
+		sd.attempts++
+		actions = append(actions, RecoveryAction{
+			Serial:  serial,
+			State:   sd.state,
+			Since:   sd.since,
+			Attempt: sd.attempts,
+		})
+		if r.exhausted(sd) {
+			// Keep the entry to not start over, but never reconnect again.
+			sd.due = time.Time{}
+			continue
+		}
+		sd.due = now.Add(sd.backoff)
+		sd.backoff *= 2
+		if sd.backoff > r.policy.MaxBackoff {
+			sd.backoff = r.policy.MaxBackoff
+		}
+	}
+	return actions
+}
+
+// next returns the time of the earliest scheduled reconnect.
+func (r *recoverer) next() (time.Time, bool) {
+	var (
+		next  time.Time
+		found bool
+	)
+	for _, sd := range r.stuck {
+		if !sd.freed.IsZero() || sd.due.IsZero() {
+			continue
+		}
+		if !found || sd.due.Before(next) {
+			next, found = sd.due, true
+		}
+	}
+	return next, found
+}
@@ -0,0 +1,118 @@
+package adb
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Reverse makes the device listen on remote and forward connections to
+// local on the host, like adb reverse. An existing reverse forward on
+// remote is replaced.
+func (d *Device) Reverse(remote, local ForwardSpec) error {
+	return d.ReverseContext(context.Background(), remote, local)
+}
+
+// ReverseContext is like Reverse but aborts when ctx is done.
+func (d *Device) ReverseContext(ctx context.Context, remote, local ForwardSpec) error {
+	err := d.reverse(ctx, "forward:"+string(remote)+";"+string(local))
+	return errors.WithMessage(err, "Reverse")
+}
+
+// ReverseNoRebind is like Reverse but fails if remote is already in use.
+func (d *Device) ReverseNoRebind(remote, local ForwardSpec) error {
+	return d.ReverseNoRebindContext(context.Background(), remote, local)
+}
+
+// ReverseNoRebindContext is like ReverseNoRebind but aborts when ctx is done.
+func (d *Device) ReverseNoRebindContext(ctx context.Context, remote, local ForwardSpec) error {
+	err := d.reverse(ctx, "forward:norebind:"+string(remote)+";"+string(local))
+	return errors.WithMessage(err, "ReverseNoRebind")
+}
+
+// ReverseRemove removes the reverse forward listening on remote.
+func (d *Device) ReverseRemove(remote ForwardSpec) error {
+	return d.ReverseRemoveContext(context.Background(), remote)
+}
+
+// ReverseRemoveContext is like ReverseRemove but aborts when ctx is done.
+func (d *Device) ReverseRemoveContext(ctx context.Context, remote ForwardSpec) error {
+	err := d.reverse(ctx, "killforward:"+string(remote))
+	return errors.WithMessage(err, "ReverseRemove")
+}
+
+// ReverseRemoveAll removes all reverse forwards of the device.
+func (d *Device) ReverseRemoveAll() error {
+	return d.ReverseRemoveAllContext(context.Background())
+}
+
+// ReverseRemoveAllContext is like ReverseRemoveAll but aborts when ctx is
+// done.
+func (d *Device) ReverseRemoveAllContext(ctx context.Context) error {
+	err := d.reverse(ctx, "killforward-all")
+	return errors.WithMessage(err, "ReverseRemoveAll")
+}
+
+// ReverseList returns the reverse forwards of the device.
+// [2]ForwardSpec is {remote, local}, remote being the device side.
+func (d *Device) ReverseList() ([][2]ForwardSpec, error) {
+	return d.ReverseListContext(context.Background())
+}
+
+// ReverseListContext is like ReverseList but aborts when ctx is done.
+func (d *Device) ReverseListContext(ctx context.Context) ([][2]ForwardSpec, error) {
+	conn, err := d.openReverse(ctx, "list-forward")
+	if err != nil {
+		return nil, errors.WithMessage(err, "ReverseList")
+	}
+	defer conn.Close()
+
+	b, err := readMessage(conn)
+	if err != nil {
+		return nil, errors.WithMessage(ctxErr(ctx, err), "ReverseList")
+	}
+	// One "<transport> <remote> <local>" line per forward.
+	var fs [][2]ForwardSpec
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, errors.Errorf("ReverseList: malformed line %q", line)
+		}
+		remote, err := ParseForwardSpec(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		local, err := ParseForwardSpec(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, [2]ForwardSpec{remote, local})
+	}
+	return fs, nil
+}
+
+// openReverse opens the reverse:<cmd> service on the device.
+func (d *Device) openReverse(ctx context.Context, cmd string) (net.Conn, error) {
+	conn, err := d.OpenService(ctx, "reverse:"+cmd)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(d.server.shortDeadline(ctx))
+	return conn, nil
+}
+
+// reverse runs a reverse:<cmd> service. After the service is opened the
+// device reports the result as a second status.
+func (d *Device) reverse(ctx context.Context, cmd string) error {
+	conn, err := d.openReverse(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return ctxErr(ctx, wantStatus(conn))
+}
@@ -2,9 +2,12 @@ package adb
 
 import (
 	"bytes"
+	"context"
 	"net"
 	"os/exec"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -24,56 +27,139 @@ const (
 // dialer used to connect to the adb server.
 // Default is the regular Dialer form net.
 // This exist only for easier mocking.
-var dial = func(address string) (net.Conn, error) { return net.Dial("tcp", address) }
+var dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
 
 // Server holds information needed to connect to a server repeatedly.
-// Use New or NewDefault to create one.
+// Use New, NewDefault or NewWithOptions to create one.
 type Server struct {
 	path    string
+	network string
 	address string
+
+	dial        func(ctx context.Context, network, address string) (net.Conn, error)
+	dialTimeout time.Duration
+	timeout     time.Duration
+	noAutostart bool
+
+	mu           sync.Mutex
+	hostFeatures FeatureSet // guarded by mu, see HostFeatures
+}
+
+// ServerOptions configures a Server created by NewWithOptions.
+// The zero value connects to the default local server and starts it if
+// necessary.
+type ServerOptions struct {
+	// Path is the adb executable used to start the server.
+	// Defaults to DefaultExecutableName.
+	Path string
+	// Network and Address locate the server, as understood by DialContext.
+	// Defaults to "tcp" and "localhost:5037".
+	Network string
+	Address string
+
+	// DialContext is used to connect to the server. It can be used to tunnel
+	// connections, e.g. through SSH. Defaults to net.Dialer.DialContext.
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+	// DialTimeout bounds establishing a connection to the server.
+	// Zero means no timeout other than the one of the context.
+	DialTimeout time.Duration
+	// Timeout bounds short request/response exchanges with the server if
+	// the context has no deadline. Defaults to 10 seconds.
+	// Long running operations like shell commands, file transfers and
+	// device watchers are only bound by their context.
+	Timeout time.Duration
+
+	// NoAutostart disables running "adb start-server". Set this when
+	// talking to a remote server or when no adb executable is available.
+	NoAutostart bool
 }
 
 // NewDefault creates a new Adb client that uses the default ServerConfig.
+// The server location can be overridden by the environment, see
+// ServerOptionsFromEnv.
 func NewDefault() (*Server, error) {
-	return New(DefaultExecutableName, "localhost", DefaultPort)
+	opts, err := ServerOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return NewWithOptions(opts)
 }
 
 // New creates a new Server.
 func New(path, host string, port int) (*Server, error) {
+	return NewWithOptions(ServerOptions{
+		Path:    path,
+		Address: net.JoinHostPort(host, strconv.Itoa(port)),
+	})
+}
+
+// NewWithOptions creates a new Server configured by opts.
+// Unless opts.NoAutostart is set the local server is started.
+func NewWithOptions(opts ServerOptions) (*Server, error) {
 	// maybe add path search for adb?
 	s := &Server{
-		path:    path,
-		address: host + ":" + strconv.Itoa(port),
+		path:        opts.Path,
+		network:     opts.Network,
+		address:     opts.Address,
+		dial:        opts.DialContext,
+		dialTimeout: opts.DialTimeout,
+		timeout:     opts.Timeout,
+		noAutostart: opts.NoAutostart,
+	}
+	if s.path == "" {
+		s.path = DefaultExecutableName
+	}
+	if s.network == "" {
+		s.network = "tcp"
+	}
+	if s.address == "" {
+		s.address = net.JoinHostPort("localhost", strconv.Itoa(DefaultPort))
+	}
+	if s.dial == nil {
+		s.dial = dial
 	}
-	err := start(s)
+	err := start(context.Background(), s)
 	if err != nil {
 		return nil, err
 	}
 	return s, nil
 }
 
-func start(s *Server) error {
-	out, err := exec.Command(s.path, "start-server").CombinedOutput()
+// start runs adb start-server. It is killed when ctx is done.
+func start(ctx context.Context, s *Server) error {
+	if s.noAutostart {
+		return nil
+	}
+	out, err := exec.CommandContext(ctx, s.path, "start-server").CombinedOutput()
 	return errors.WithMessagef(err, "error starting server. Output:\n%s", out)
 }
 
 // requestResponseBytes sends msg to server and returns the response.
 // The connection is closed. It prepends "host:" to the message.
-// The connection times out after 10 seconds.
-func (s *Server) requestResponseBytes(msg string) ([]byte, error) {
-	return requestResponseBytes(s.address, "host:"+msg)
+// The connection times out after the servers timeout unless ctx has a
+// deadline.
+func (s *Server) requestResponseBytes(ctx context.Context, msg string) ([]byte, error) {
+	return requestResponseBytes(ctx, s, "host:"+msg)
 }
 
 // send sends msg to server reads status then closes the connection.
 // prepends 'host:'
-func (s *Server) send(msg string) error {
-	return send(s.address, "host:"+msg)
+func (s *Server) send(ctx context.Context, msg string) error {
+	return send(ctx, s, "host:"+msg)
 }
 
 // Version asks the adb server for its internal version number.
-// TODO(jmh): Check server version format
 func (s *Server) Version() (int, error) {
-	b, err := s.requestResponseBytes("version")
+	return s.VersionContext(context.Background())
+}
+
+// VersionContext is like Version but aborts when ctx is done.
+// TODO(jmh): Check server version format
+func (s *Server) VersionContext(ctx context.Context) (int, error) {
+	b, err := s.requestResponseBytes(ctx, "version")
 	if err != nil {
 		return 0, err
 	}
@@ -84,12 +170,17 @@ func (s *Server) Version() (int, error) {
 
 // Kill tells the server to quit immediately.
 func (s *Server) Kill() error {
-	return s.send("kill")
+	return s.send(context.Background(), "kill")
 }
 
 // ListDevices returns the list of connected devices.
 func (s *Server) ListDevices() ([]DeviceInfo, error) {
-	b, err := s.requestResponseBytes("devices-l")
+	return s.ListDevicesContext(context.Background())
+}
+
+// ListDevicesContext is like ListDevices but aborts when ctx is done.
+func (s *Server) ListDevicesContext(ctx context.Context) ([]DeviceInfo, error) {
+	b, err := s.requestResponseBytes(ctx, "devices-l")
 	if err != nil {
 		return nil, err
 	}
@@ -98,7 +189,13 @@ func (s *Server) ListDevices() ([]DeviceInfo, error) {
 
 // ListDeviceSerials returns the serial numbers of all attached devices.
 func (s *Server) ListDeviceSerials() ([]string, error) {
-	b, err := s.requestResponseBytes("devices")
+	return s.ListDeviceSerialsContext(context.Background())
+}
+
+// ListDeviceSerialsContext is like ListDeviceSerials but aborts when ctx is
+// done.
+func (s *Server) ListDeviceSerialsContext(ctx context.Context) ([]string, error) {
+	b, err := s.requestResponseBytes(ctx, "devices")
 	if err != nil {
 		return nil, err
 	}
@@ -136,3 +233,45 @@ func (s *Server) Device(serial string) *Device {
 		serial: serial,
 	}
 }
+
+// DeviceByTransportID returns the device with the given transport id.
+// Unlike serial numbers transport ids are unique and not reused when a
+// device reconnects. Returns nil on error.
+func (s *Server) DeviceByTransportID(id int64) *Device {
+	devices, err := s.ListDevices()
+	if err != nil {
+		return nil
+	}
+	for _, dev := range devices {
+		if dev.TransportID == id {
+			return &Device{
+				server:      s,
+				serial:      dev.Serial,
+				transportID: id,
+			}
+		}
+	}
+	return nil
+}
+
+// USBDevice returns the only device connected via USB, like adb -d.
+// Returns nil if there is none or more than one.
+func (s *Server) USBDevice() *Device {
+	return s.deviceByKind(kindUSB)
+}
+
+// LocalDevice returns the only device connected via TCP or emulator, like
+// adb -e. Returns nil if there is none or more than one.
+func (s *Server) LocalDevice() *Device {
+	return s.deviceByKind(kindLocal)
+}
+
+func (s *Server) deviceByKind(kind transportKind) *Device {
+	d := &Device{server: s, kind: kind}
+	serial, err := d.Serial()
+	if err != nil {
+		return nil
+	}
+	d.serial = serial
+	return d
+}
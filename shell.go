@@ -0,0 +1,149 @@
+package adb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ShellOptions configures an interactive shell session, see Device.Shell.
+type ShellOptions struct {
+	// Command is run instead of an interactive login shell if set.
+	Command string
+	// Term is the TERM of the session. Defaults to "dumb".
+	Term string
+	// Stdin is sent to the session if set. Its end closes the input.
+	Stdin io.Reader
+	// Stdout receives the output of the session, it is discarded if nil.
+	// A terminal has no separate error output.
+	Stdout io.Writer
+	// Rows and Cols are the initial window size if set.
+	Rows, Cols int
+}
+
+// ShellSession is a shell on a device running in a PTY, like adb shell on
+// a terminal. Use Device.Shell to start one.
+type ShellSession struct {
+	conn   net.Conn
+	shell2 bool // conn speaks the shell protocol v2
+
+	// w writes the packets to conn, they are sent from several goroutines.
+	w *lockedWriter
+
+	// done is closed once the output is copied, setting exitCode and err.
+	done     chan struct{}
+	exitCode int
+	err      error
+}
+
+// Shell starts an interactive shell session. Devices without shell protocol
+// v2, see FeatureShell2, neither support resizing nor report the exit code.
+// The session is closed when ctx is done.
+func (d *Device) Shell(ctx context.Context, opts ShellOptions) (*ShellSession, error) {
+	if opts.Term == "" {
+		opts.Term = "dumb"
+	}
+	if opts.Stdout == nil {
+		opts.Stdout = ioutil.Discard
+	}
+	s := &ShellSession{
+		shell2:   d.hasFeature(ctx, FeatureShell2),
+		done:     make(chan struct{}),
+		exitCode: -1,
+	}
+	service := "shell:" + opts.Command
+	if s.shell2 {
+		service = "shell,v2,TERM=" + opts.Term + ",pty:" + opts.Command
+	}
+	conn, err := d.OpenService(ctx, service)
+	if err != nil {
+		return nil, errors.WithMessage(err, "Shell")
+	}
+	s.conn = conn
+	s.w = &lockedWriter{w: conn}
+
+	if s.shell2 && opts.Rows > 0 && opts.Cols > 0 {
+		if err := s.Resize(opts.Rows, opts.Cols); err != nil {
+			conn.Close()
+			return nil, errors.WithMessage(ctxErr(ctx, err), "Shell")
+		}
+	}
+	switch {
+	case opts.Stdin == nil:
+	case s.shell2:
+		go copyShellStdin(s.w, opts.Stdin)
+	default:
+		go io.Copy(conn, opts.Stdin)
+	}
+	go func() {
+		if s.shell2 {
+			s.exitCode, s.err = demuxShell(conn, opts.Stdout, opts.Stdout)
+		} else {
+			_, s.err = io.Copy(opts.Stdout, conn)
+		}
+		s.err = ctxErr(ctx, s.err)
+		close(s.done)
+	}()
+	return s, nil
+}
+
+// Resize changes the window size of the terminal, e.g. after the local
+// terminal was resized. It returns ErrNotImplemented on devices without
+// shell protocol v2.
+func (s *ShellSession) Resize(rows, cols int) error {
+	if !s.shell2 {
+		return ErrNotImplemented
+	}
+	// rows x cols, x pixels x y pixels
+	ws := fmt.Sprintf("%dx%d,%dx%d", rows, cols, 0, 0)
+	return writeShellPacket(s.w, shellWindowSize, []byte(ws))
+}
+
+// Wait waits for the session to end. If the shell exits with a non-zero
+// code the error is a *ShellExitError.
+func (s *ShellSession) Wait() error {
+	<-s.done
+	s.conn.Close()
+	if s.err != nil {
+		return s.err
+	}
+	if s.exitCode > 0 {
+		return &ShellExitError{Command: "shell", ExitCode: s.exitCode}
+	}
+	return nil
+}
+
+// ExitCode returns the exit code of the ended session or -1 if it is still
+// running or the device does not report it.
+func (s *ShellSession) ExitCode() int {
+	select {
+	case <-s.done:
+		return s.exitCode
+	default:
+		return -1
+	}
+}
+
+// lockedWriter serializes the writes to w.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(b []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(b)
+}
+
+// Close ends the session.
+func (s *ShellSession) Close() error {
+	err := s.conn.Close()
+	<-s.done
+	return err
+}
@@ -0,0 +1,110 @@
+package adb
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Packet ids of the shell protocol v2, see adb/shell_protocol.h.
+// Every packet starts with the id and the length of its payload as little
+// endian uint32.
+const (
+	shellStdin      byte = 0
+	shellStdout     byte = 1
+	shellStderr     byte = 2
+	shellExit       byte = 3
+	shellCloseStdin byte = 4
+	shellWindowSize byte = 5
+	shellHeaderSize      = 5
+	shellMaxPayload      = 1 << 20
+)
+
+// writeShellPacket writes a packet with id and payload to w.
+func writeShellPacket(w io.Writer, id byte, payload []byte) error {
+	buf := make([]byte, shellHeaderSize, shellHeaderSize+len(payload))
+	buf[0] = id
+	binary.LittleEndian.PutUint32(buf[1:], uint32(len(payload)))
+	buf = append(buf, payload...)
+	n, err := w.Write(buf)
+	if err != nil {
+		return err
+	}
+	if n != len(buf) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
+// copyShellStdin sends r to w in stdin packets and closes the input at the
+// end, also if r is nil. Errors are not reported as the remote side may
+// exit without reading all of its input.
+func copyShellStdin(w io.Writer, r io.Reader) {
+	if r != nil {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				if writeShellPacket(w, shellStdin, buf[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	// There is no more input, commands reading stdin must not hang.
+	writeShellPacket(w, shellCloseStdin, nil)
+}
+
+// readShellPacket reads the next packet from r. The payload is read into
+// buf if it fits.
+func readShellPacket(r io.Reader, buf []byte) (id byte, payload []byte, err error) {
+	var head [shellHeaderSize]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.LittleEndian.Uint32(head[1:])
+	if length > shellMaxPayload {
+		return 0, nil, errors.Errorf("shell packet too large: %d", length)
+	}
+	if int(length) > len(buf) {
+		buf = make([]byte, length)
+	}
+	payload = buf[:length]
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, errors.Wrap(io.ErrUnexpectedEOF, "truncated shell packet")
+	}
+	return head[0], payload, nil
+}
+
+// demuxShell copies the stdout and stderr packets from r to stdout and
+// stderr until the exit packet and returns the exit code.
+func demuxShell(r io.Reader, stdout, stderr io.Writer) (int, error) {
+	buf := make([]byte, 32*1024)
+	for {
+		id, payload, err := readShellPacket(r, buf)
+		if err == io.EOF {
+			return -1, errors.New("shell closed without exit code")
+		}
+		if err != nil {
+			return -1, err
+		}
+		switch id {
+		case shellStdout:
+			_, err = stdout.Write(payload)
+		case shellStderr:
+			_, err = stderr.Write(payload)
+		case shellExit:
+			if len(payload) != 1 {
+				return -1, errors.New("malformed exit packet")
+			}
+			return int(payload[0]), nil
+		}
+		if err != nil {
+			return -1, err
+		}
+	}
+}
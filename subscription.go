@@ -0,0 +1,204 @@
+package adb
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// DropPolicy decides what happens to events for a subscriber that does not
+// keep up, i.e. whose buffer is full.
+type DropPolicy uint8
+
+const (
+	// DropOldest discards the oldest buffered event to make room. It is the
+	// default.
+	DropOldest DropPolicy = iota
+	// DropNewest discards events that do not fit into the buffer.
+	DropNewest
+	// Block makes the watcher wait for the subscriber. Meanwhile no other
+	// subscriber receives events.
+	Block
+)
+
+// SubscribeOptions configures a Subscription.
+type SubscribeOptions struct {
+	// Serial limits the events to the device with this serial if set.
+	Serial string
+	// Filter limits the events to those it returns true for if set.
+	// It must not block.
+	Filter func(DeviceStateChangedEvent) bool
+	// Buffer is the number of events buffered for the subscriber.
+	// Defaults to 16.
+	Buffer int
+	// Drop decides what happens if the buffer is full. Defaults to
+	// DropOldest.
+	Drop DropPolicy
+}
+
+// Subscription receives events from a DeviceWatcher independently of other
+// subscriptions. Use DeviceWatcher.Subscribe to get one.
+type Subscription struct {
+	dropped uint64 // accessed atomically, keep first for alignment
+
+	w        *DeviceWatcher
+	opts     SubscribeOptions
+	snapshot map[string]DeviceState
+	done     chan struct{}
+	once     sync.Once
+
+	mu     sync.Mutex // serializes sending on and closing ch
+	ch     chan DeviceStateChangedEvent
+	closed bool // guarded by mu
+}
+
+// Subscribe returns a new subscription to the events of w filtered by opts.
+// The subscription should be closed once it is not needed anymore.
+// If w is closed already the channel of the subscription is closed.
+func (w *DeviceWatcher) Subscribe(opts SubscribeOptions) *Subscription {
+	return w.subscribe(opts, false)
+}
+
+// subscribe creates a new subscription. If replay is set it starts with an
+// event for every known device, as if it had just connected.
+func (w *DeviceWatcher) subscribe(opts SubscribeOptions, replay bool) *Subscription {
+	if opts.Buffer <= 0 {
+		opts.Buffer = 16
+	}
+	sub := &Subscription{
+		w:    w,
+		opts: opts,
+		done: make(chan struct{}),
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	sub.snapshot = w.snapshot()
+
+	var initial []DeviceStateChangedEvent
+	if replay {
+		keys := make([]deviceKey, 0, len(w.known))
+		for key := range w.known {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].serial != keys[j].serial {
+				return keys[i].serial < keys[j].serial
+			}
+			return keys[i].transportID < keys[j].transportID
+		})
+		for _, key := range keys {
+			gone := DeviceInfo{Serial: key.serial, State: StateDisconnected}
+			ev := newDeviceEvent(gone, w.known[key], w.opts.Long)
+			if sub.matches(ev) {
+				initial = append(initial, ev)
+			}
+		}
+	}
+	size := opts.Buffer
+	if len(initial) > size {
+		size = len(initial)
+	}
+	sub.ch = make(chan DeviceStateChangedEvent, size)
+	for _, ev := range initial {
+		sub.ch <- ev
+	}
+
+	if w.stopped {
+		sub.close()
+		return sub
+	}
+	w.subs = append(w.subs, sub)
+	return sub
+}
+
+// C returns the channel events are delivered on. It is closed when the
+// subscription or the watcher is closed.
+func (s *Subscription) C() <-chan DeviceStateChangedEvent {
+	return s.ch
+}
+
+// Snapshot returns the state of all devices known when subscribing.
+// The events received on C start from this view. Don't modify the map.
+func (s *Subscription) Snapshot() map[string]DeviceState {
+	return s.snapshot
+}
+
+// Dropped returns the number of events discarded due to the drop policy.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close ends the subscription and closes the channel returned by C.
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		// Unblock a pending publish before taking the lock it holds.
+		close(s.done)
+		s.w.mu.Lock()
+		for i, sub := range s.w.subs {
+			if sub == s {
+				s.w.subs = append(s.w.subs[:i], s.w.subs[i+1:]...)
+				break
+			}
+		}
+		s.w.mu.Unlock()
+		s.close()
+	})
+}
+
+// close closes ch unless it is closed already.
+func (s *Subscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+}
+
+func (s *Subscription) matches(ev DeviceStateChangedEvent) bool {
+	if s.opts.Serial != "" && ev.Serial != s.opts.Serial {
+		return false
+	}
+	return s.opts.Filter == nil || s.opts.Filter(ev)
+}
+
+// publish delivers ev according to the drop policy. Events must be
+// published by one goroutine at a time to keep their order.
+func (s *Subscription) publish(ev DeviceStateChangedEvent) {
+	if !s.matches(ev) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	switch s.opts.Drop {
+	case DropNewest:
+		select {
+		case s.ch <- ev:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	case DropOldest:
+		for {
+			select {
+			case s.ch <- ev:
+				return
+			default:
+			}
+			select {
+			case <-s.ch:
+				atomic.AddUint64(&s.dropped, 1)
+			default:
+			}
+		}
+	case Block:
+		select {
+		case s.ch <- ev:
+		case <-s.done:
+		case <-s.w.ctx.Done():
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package adb
 
 import (
+	"context"
 	"encoding/binary"
 	"io"
 	"net"
@@ -76,23 +77,21 @@ func sendFile(conn io.ReadWriteCloser, path string, mode os.FileMode, mtime time
 	return &syncFileWriter{mtime, conn}, nil
 }
 
-func openSyncConn(address, serial string) (net.Conn, error) {
-	conn, err := dial(address)
-	if err != nil {
-		return nil, err
-	}
-	_, err = conn.Write([]byte("host-serial:" + serial + ":sync:"))
-	if err != nil {
-		conn.Close()
-		return nil, err
-	}
-	return conn, nil
+// openSyncConn opens a sync connection to d. The connection is closed when
+// ctx is done.
+func openSyncConn(ctx context.Context, d *Device) (net.Conn, error) {
+	return d.OpenService(ctx, "sync:")
 }
 
 // List lists the directory contents of path on file.
 // move this to sync
 func (d *Device) List(path string) ([]DirEntry, error) {
-	conn, err := openSyncConn(d.server.address, d.serial)
+	return d.ListContext(context.Background(), path)
+}
+
+// ListContext is like List but aborts when ctx is done.
+func (d *Device) ListContext(ctx context.Context, path string) ([]DirEntry, error) {
+	conn, err := openSyncConn(ctx, d)
 	if err != nil {
 		return nil, err
 	}
@@ -102,31 +101,44 @@ func (d *Device) List(path string) ([]DirEntry, error) {
 	if err != nil {
 		return nil, err
 	}
-	return ReadAllDirEntries(conn)
+	entries, err := ReadAllDirEntries(conn)
+	return entries, ctxErr(ctx, err)
 }
 
 // Stat returns filestats of path on device.
 func (d *Device) Stat(path string) (DirEntry, error) {
-	conn, err := openSyncConn(d.server.address, d.serial)
+	return d.StatContext(context.Background(), path)
+}
+
+// StatContext is like Stat but aborts when ctx is done.
+func (d *Device) StatContext(ctx context.Context, path string) (DirEntry, error) {
+	conn, err := openSyncConn(ctx, d)
 	if err != nil {
 		return DirEntry{}, errors.Wrapf(err, "Stat(%s)", path)
 	}
 	defer conn.Close()
 
 	entry, err := stat(conn, path)
-	return entry, errors.WithMessagef(err, "Stat(%s)", path)
+	return entry, errors.WithMessagef(ctxErr(ctx, err), "Stat(%s)", path)
 }
 
 // ReadFile returns a a reader for the given path on the device.
 func (d *Device) ReadFile(path string) (io.ReadCloser, error) {
-	conn, err := openSyncConn(d.server.address, d.serial)
+	return d.ReadFileContext(context.Background(), path)
+}
+
+// ReadFileContext is like ReadFile but the returned reader fails with
+// ctx.Err() once ctx is done.
+func (d *Device) ReadFileContext(ctx context.Context, path string) (io.ReadCloser, error) {
+	conn, err := openSyncConn(ctx, d)
 	if err != nil {
 		return nil, errors.Wrapf(err, "OpenRead(%s)", path)
 	}
 	// don't close as syncfilereader get ioreadcloser
 	err = sendSyncMessage(conn, statusSyncRecv, path)
 	if err != nil {
-		return nil, err
+		conn.Close()
+		return nil, ctxErr(ctx, err)
 	}
 	return newSyncFileReader(conn)
 }
@@ -137,7 +149,7 @@ func (d *Device) ReadFile(path string) (io.ReadCloser, error) {
 // is TimeOfClose, which will use the time the Close method is called as the modification time.
 // Deprecate this. Use CopyFile instead!
 func (d *Device) OpenWrite(path string, perms os.FileMode, mtime time.Time) (io.WriteCloser, error) {
-	conn, err := openSyncConn(d.server.address, d.serial)
+	conn, err := openSyncConn(context.Background(), d)
 	if err != nil {
 		return nil, errors.Wrapf(err, "OpenWrite(%s)", path)
 	}
@@ -153,55 +165,80 @@ func (d *Device) OpenWrite(path string, perms os.FileMode, mtime time.Time) (io.
 
 // CopyFile copies the contents of r writing them to path on the device.
 func (d *Device) CopyFile(path string, r io.Reader, perms os.FileMode, modtime time.Time) (int, error) {
-	conn, err := openSyncConn(d.server.address, d.serial)
+	return d.CopyFileContext(context.Background(), path, r, perms, modtime)
+}
+
+// CopyFileContext is like CopyFile but aborts the transfer when ctx is done.
+// It returns the number of bytes sent.
+func (d *Device) CopyFileContext(ctx context.Context, path string, r io.Reader, perms os.FileMode, modtime time.Time) (int, error) {
+	conn, err := openSyncConn(ctx, d)
 	if err != nil {
-		return 0, err
+		return 0, errors.WithMessagef(err, "CopyFile(%s)", path)
 	}
 	defer conn.Close()
 
 	pathAndMode := path + "," + strconv.Itoa(int(perms.Perm()))
-	// sync message!
 	err = sendSyncMessage(conn, statusSyncSend, pathAndMode)
 	if err != nil {
-		return 0, err
+		return 0, errors.WithMessagef(ctxErr(ctx, err), "CopyFile(%s)", path)
 	}
 
+	// Every chunk is sent as DATA with its length, followed by DONE with
+	// the modification time.
 	var (
-		buf         = make([]byte, 64*1024)
-		er          error
-		nr, written int
+		buf     = make([]byte, 8+syncMaxChunkSize)
+		written int
 	)
-
-	// TODO(jmh): write time and close
-	for er != nil {
-		nr, er = r.Read(buf)
-		wbuf := buf[:nr]
-		for len(wbuf) > 0 {
-			_, ew := conn.Write([]byte(statusSyncData))
-			if ew != nil {
-				return written, ew
+	copy(buf, statusSyncData)
+	for {
+		n, er := r.Read(buf[8:])
+		if n > 0 {
+			binary.LittleEndian.PutUint32(buf[4:8], uint32(n))
+			if _, err := conn.Write(buf[:8+n]); err != nil {
+				return written, errors.WithMessagef(ctxErr(ctx, err), "CopyFile(%s)", path)
 			}
-			// correct?
-			length := make([]byte, 4)
-			binary.LittleEndian.PutUint32(length, uint32(len(wbuf)))
-			_, ew = conn.Write(length[:])
-			if ew != nil {
-				return written, ew
-			}
-			nw, ew := conn.Write(wbuf)
-			if ew != nil {
-				return written + nw, ew
-			}
-
-			written += nw
-			wbuf = wbuf[nw:]
+			written += n
 		}
-		if er != nil {
-			return written, er
+		if er == io.EOF {
+			break
+		} else if er != nil {
+			return written, errors.WithMessagef(er, "CopyFile(%s)", path)
 		}
 	}
-	if er != io.EOF {
-		return written, er
+
+	if modtime.IsZero() {
+		modtime = time.Now()
+	}
+	copy(buf, statusSyncDone)
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(modtime.Unix()))
+	_, err = conn.Write(buf[:8])
+	if err == nil {
+		err = readSyncStatus(conn)
+	}
+	return written, errors.WithMessagef(ctxErr(ctx, err), "CopyFile(%s)", path)
+}
+
+// readSyncStatus reads the OKAY or FAIL reply to a sync request. Unlike in
+// replies of the server the length is binary.
+func readSyncStatus(r io.Reader) error {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	status := string(buf[:4])
+	length := binary.LittleEndian.Uint32(buf[4:])
+	switch status {
+	case statusOK:
+		return nil
+	case statusFail:
+		if length > syncMaxChunkSize {
+			return errors.Errorf("sync error message too long: %d", length)
+		}
+		msg := make([]byte, length)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return err
+		}
+		return errors.New(string(msg))
 	}
-	return written, nil
+	return &UnexpectedStatusError{[]string{statusOK, statusFail}, status}
 }
@@ -82,7 +82,7 @@ func readNextChunk(r io.Reader) (io.Reader, error) {
 		return nil, &UnexpectedStatusError{[]string{statusSyncDone, statusSyncData}, status}
 	}
 	length := binary.LittleEndian.Uint32(buf[4:])
-	return &io.LimitedReader{r, int64(length)}, nil
+	return &io.LimitedReader{R: r, N: int64(length)}, nil
 }
 
 // readFileNotFoundPredicate returns true if s is the adb server error message
@@ -0,0 +1,243 @@
+package adb
+
+import (
+	"context"
+	"encoding/binary"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// AppProcess is a debuggable or profileable app process as reported by the
+// track-app service, available since Android 12.
+type AppProcess struct {
+	Pid          int
+	Debuggable   bool
+	Profileable  bool
+	Architecture string
+}
+
+// AppEventType tells what happened to the process of an AppEvent.
+type AppEventType uint8
+
+const (
+	// AppAdded reports a process that started, or was running when
+	// tracking began.
+	AppAdded AppEventType = iota + 1
+	// AppChanged reports a process whose properties changed, e.g. it
+	// became profileable.
+	AppChanged
+	// AppRemoved reports a process that ended.
+	AppRemoved
+)
+
+// AppEvent reports a change of an app process.
+type AppEvent struct {
+	Type    AppEventType
+	Process AppProcess
+}
+
+// AppProcesses returns the debuggable and profileable app processes of the
+// device. It requires Android 12 or later, see FeatureTrackApp.
+func (d *Device) AppProcesses() ([]AppProcess, error) {
+	return d.AppProcessesContext(context.Background())
+}
+
+// AppProcessesContext is like AppProcesses but aborts when ctx is done.
+func (d *Device) AppProcessesContext(ctx context.Context) ([]AppProcess, error) {
+	b, err := d.trackOnce(ctx, "track-app")
+	if err != nil {
+		return nil, errors.WithMessage(err, "AppProcesses")
+	}
+	pp, err := decodeAppProcesses(b)
+	return pp, errors.WithMessage(err, "AppProcesses")
+}
+
+// AppTracker reports debuggable and profileable app processes on a device
+// as they come and go. Use Device.TrackApp to create one.
+type AppTracker struct {
+	tracker
+	c chan AppEvent
+}
+
+// TrackApp starts tracking the debuggable and profileable app processes of
+// the device. It requires Android 12 or later, see FeatureTrackApp.
+// The first events add the processes running at the time. The tracker stops
+// when ctx is done, it is closed or the connection fails.
+func (d *Device) TrackApp(ctx context.Context) (*AppTracker, error) {
+	tr, err := d.openTracker(ctx, "track-app")
+	if err != nil {
+		return nil, errors.WithMessage(err, "TrackApp")
+	}
+	t := &AppTracker{tracker: tr, c: make(chan AppEvent)}
+	go t.run()
+	return t, nil
+}
+
+// C returns the channel events are delivered on. It is closed when the
+// tracker stops.
+func (t *AppTracker) C() <-chan AppEvent {
+	return t.c
+}
+
+func (t *AppTracker) run() {
+	defer close(t.c)
+	known := make(map[int]AppProcess)
+	t.tracker.run("TrackApp", func(b []byte) error {
+		pp, err := decodeAppProcesses(b)
+		if err != nil {
+			return err
+		}
+		for _, ev := range diffAppProcesses(known, pp) {
+			select {
+			case t.c <- ev:
+			case <-t.ctx.Done():
+				return t.ctx.Err()
+			}
+		}
+		return nil
+	})
+}
+
+// diffAppProcesses updates known to pp and returns the events for the
+// processes removed, changed and added, each sorted by pid.
+func diffAppProcesses(known map[int]AppProcess, pp []AppProcess) []AppEvent {
+	var events []AppEvent
+	cur := make(map[int]bool, len(pp))
+	for _, p := range pp {
+		cur[p.Pid] = true
+	}
+	for pid, p := range known {
+		if !cur[pid] {
+			events = append(events, AppEvent{AppRemoved, p})
+			delete(known, pid)
+		}
+	}
+	for _, p := range pp {
+		old, ok := known[p.Pid]
+		switch {
+		case !ok:
+			events = append(events, AppEvent{AppAdded, p})
+		case old != p:
+			events = append(events, AppEvent{AppChanged, p})
+		default:
+			continue
+		}
+		known[p.Pid] = p
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Type != events[j].Type {
+			return events[i].Type > events[j].Type
+		}
+		return events[i].Process.Pid < events[j].Process.Pid
+	})
+	return events
+}
+
+// decodeAppProcesses decodes the protobuf message sent by track-app, see
+// packages/modules/adb/proto/app_processes.proto in AOSP:
+//
+//	message AppProcesses {
+//	    repeated ProcessEntry process = 1;
+//	}
+func decodeAppProcesses(b []byte) ([]AppProcess, error) {
+	var pp []AppProcess
+	err := decodeProto(b, func(num int, v uint64, data []byte) error {
+		if num != 1 || data == nil {
+			return nil
+		}
+		p, err := decodeProcessEntry(data)
+		if err != nil {
+			return err
+		}
+		pp = append(pp, p)
+		return nil
+	})
+	return pp, errors.WithMessage(err, "malformed AppProcesses")
+}
+
+// decodeProcessEntry decodes the ProcessEntry of Android 12, where
+// track-app was added:
+//
+//	message ProcessEntry {
+//	    int64 pid = 1;
+//	    bool debuggable = 2;
+//	    bool profileable = 3;
+//	    string architecture = 4;
+//	}
+//
+// Fields added by later releases are skipped.
+func decodeProcessEntry(b []byte) (AppProcess, error) {
+	var p AppProcess
+	err := decodeProto(b, func(num int, v uint64, data []byte) error {
+		switch num {
+		case 1:
+			p.Pid = int(v)
+		case 2:
+			p.Debuggable = v != 0
+		case 3:
+			p.Profileable = v != 0
+		case 4:
+			p.Architecture = string(data)
+		}
+		return nil
+	})
+	return p, err
+}
+
+// protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// decodeProto calls fn for every field of the protobuf message b with the
+// field number and either the value of a numeric field or the content of a
+// length delimited field. The content is non-nil for length delimited
+// fields, even if empty.
+func decodeProto(b []byte, fn func(num int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("malformed field key")
+		}
+		b = b[n:]
+
+		var (
+			v    uint64
+			data []byte
+		)
+		switch key & 7 {
+		case protoVarint:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errors.New("malformed varint")
+			}
+			b = b[n:]
+		case protoFixed64:
+			if len(b) < 8 {
+				return errors.New("truncated fixed64")
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case protoFixed32:
+			if len(b) < 4 {
+				return errors.New("truncated fixed32")
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case protoBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errors.New("malformed length")
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return errors.Errorf("unsupported wire type %d", key&7)
+		}
+		if err := fn(int(key>>3), v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package adb
+
+import (
+	"context"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// tracker reads the updates sent by a track service like track-jdwp. Each
+// update is a length prefixed message.
+type tracker struct {
+	conn   net.Conn
+	ctx    context.Context
+	cancel context.CancelFunc
+	err    error
+}
+
+// openTracker opens service for a tracker that stops when ctx is done.
+func (d *Device) openTracker(ctx context.Context, service string) (tracker, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	conn, err := d.OpenService(ctx, service)
+	if err != nil {
+		cancel()
+		return tracker{}, err
+	}
+	return tracker{conn: conn, ctx: ctx, cancel: cancel}, nil
+}
+
+// trackOnce returns the first update of service. It lists everything
+// currently tracked.
+func (d *Device) trackOnce(ctx context.Context, service string) ([]byte, error) {
+	conn, err := d.OpenService(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(d.server.shortDeadline(ctx))
+	b, err := readMessage(conn)
+	return b, ctxErr(ctx, err)
+}
+
+// Err returns the error that stopped the tracker once C is closed.
+// It is nil if the tracker was closed or ctx was cancelled.
+func (t *tracker) Err() error {
+	return t.err
+}
+
+// Close stops the tracker.
+func (t *tracker) Close() error {
+	t.cancel()
+	return nil
+}
+
+// run calls update with every update received until update or the
+// connection fails, or the tracker is stopped. op prefixes the error.
+func (t *tracker) run(op string, update func(b []byte) error) {
+	defer t.conn.Close()
+	for {
+		b, err := readMessage(t.conn)
+		if err == nil {
+			err = update(b)
+		}
+		if err != nil {
+			if t.ctx.Err() == nil {
+				t.err = errors.WithMessage(err, op)
+			}
+			t.cancel()
+			return
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package adb
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// WaitTransport selects the kind of devices WaitFor waits for.
+type WaitTransport string
+
+// Transports accepted by WaitFor.
+const (
+	WaitAny   WaitTransport = "any"
+	WaitUSB   WaitTransport = "usb"
+	WaitLocal WaitTransport = "local"
+)
+
+// WaitFor blocks until a device connected via transport reaches state or
+// ctx is done. Supported states are StateOnline, StateBootloader,
+// StateRecovery, StateRescue, StateSideload and StateDisconnected.
+// As for adb wait-for-device the server fails if more than one device
+// matches.
+func (s *Server) WaitFor(ctx context.Context, transport WaitTransport, state DeviceState) error {
+	req, err := waitForRequest(transport, state)
+	if err != nil {
+		return err
+	}
+	return errors.WithMessage(waitFor(ctx, s, "host:"+req), "WaitFor")
+}
+
+// WaitFor blocks until d reaches state or ctx is done. See Server.WaitFor
+// for the supported states.
+func (d *Device) WaitFor(ctx context.Context, state DeviceState) error {
+	transport := WaitAny
+	if d.transportID == 0 {
+		switch d.kind {
+		case kindUSB:
+			transport = WaitUSB
+		case kindLocal:
+			transport = WaitLocal
+		}
+	}
+	req, err := waitForRequest(transport, state)
+	if err != nil {
+		return err
+	}
+	return errors.WithMessage(waitFor(ctx, d.server, d.hostPrefix()+req), "WaitFor")
+}
+
+func waitForRequest(transport WaitTransport, state DeviceState) (string, error) {
+	switch transport {
+	case WaitAny, WaitUSB, WaitLocal:
+	default:
+		return "", errors.Errorf("WaitFor: unsupported transport %q", transport)
+	}
+	var s string
+	switch state {
+	case StateOnline, StateBootloader, StateRecovery, StateRescue, StateSideload:
+		s = formatDeviceState(state)
+	case StateDisconnected:
+		s = "disconnect"
+	default:
+		return "", errors.Errorf("WaitFor: unsupported state %v", state)
+	}
+	return "wait-for-" + string(transport) + "-" + s, nil
+}
+
+// waitFor sends a wait-for request. The server acknowledges the request
+// with OKAY and sends a second OKAY once the state is reached.
+func waitFor(ctx context.Context, s *Server, msg string) error {
+	conn, err := s.dialContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	err = sendMessage(conn, msg)
+	if err == nil {
+		err = wantStatus(conn)
+	}
+	if err == nil {
+		err = wantStatus(conn)
+	}
+	return ctxErr(ctx, err)
+}